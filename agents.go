@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AgentRegisterRequest is sent by a sandbox agent when it starts.
+type AgentRegisterRequest struct {
+	// Name is the server's name, which is also its hostname on providers
+	// that set one.
+	Name string `json:"name"`
+	// Address is the host[:port] the control plane should reach the agent
+	// on; empty keeps the address the provider reported.
+	Address string `json:"address,omitempty"`
+	AgentHeartbeatRequest
+}
+
+type AgentRegisterResponse struct {
+	ServerID                 string `json:"server_id"`
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds"`
+	// AgentToken is what the agent requires on its API from now on, and
+	// what it registers and heartbeats with.
+	AgentToken string `json:"agent_token"`
+}
+
+// AgentHeartbeatRequest is sent by a registered agent every heartbeat interval.
+type AgentHeartbeatRequest struct {
+	Version    string    `json:"version"`
+	Capacity   Resources `json:"capacity"`
+	SandboxIDs []string  `json:"sandbox_ids"`
+}
+
+// agentToken is the token the control plane presents to the agent it
+// reaches at host. It is derived from the shared bootstrap token, so there is
+// nothing to store, and an agent only learns its own.
+func agentToken(secret string, host string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func tokensEqual(a string, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// bootstrapToken is issued to a server when it is created. It goes into the
+// server's user data, which anything on the server can read, so each use is
+// good once: phoning home, and registering the agent.
+type bootstrapToken struct {
+	value string
+	used  map[bootstrapTokenUse]bool
+}
+
+type bootstrapTokenUse string
+
+const (
+	phoneHomeUse bootstrapTokenUse = "phone-home"
+	registerUse  bootstrapTokenUse = "register"
+)
+
+func (s *ServerHandler) issueBootstrapToken(name string) (string, error) {
+	value, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+	s.bootstrapTokens[name] = &bootstrapToken{value: value, used: make(map[bootstrapTokenUse]bool)}
+	return value, nil
+}
+
+// useBootstrapToken reports whether value is the named server's bootstrap
+// token and hasn't been used for use yet, and marks it used.
+func (s *ServerHandler) useBootstrapToken(name string, value string, use bootstrapTokenUse) bool {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+	token, ok := s.bootstrapTokens[name]
+	if !ok || token.used[use] || !tokensEqual(value, token.value) {
+		return false
+	}
+	token.used[use] = true
+	if token.used[phoneHomeUse] && token.used[registerUse] {
+		delete(s.bootstrapTokens, name)
+	}
+	return true
+}
+
+func (s *ServerHandler) revokeBootstrapToken(name string) {
+	s.tokensMu.Lock()
+	defer s.tokensMu.Unlock()
+	delete(s.bootstrapTokens, name)
+}
+
+// AuthorizeAgent checks the token an agent sends with its heartbeats: the
+// server's agent token, or the shared one for agents started by hand.
+func (s *ServerHandler) AuthorizeAgent(ID string, token string) error {
+	server, err := s.GetServer(ID)
+	if err != nil {
+		return err
+	}
+	if !tokensEqual(token, agentToken(s.token, server.IP)) && !tokensEqual(token, s.token) {
+		return UnauthorizedError("Invalid agent token for server '%s'", ID)
+	}
+	return nil
+}
+
+// RegisterAgent ties an agent to the server it runs on, matching it by name,
+// or by address for servers agents added themselves, and records a server for
+// it if none is known yet. token must be the server's unused bootstrap token,
+// its agent token, or the shared token. The address of a server a provider
+// created is the provider's, so its agent can't move it elsewhere.
+func (s *ServerHandler) RegisterAgent(request AgentRegisterRequest, token string) (Server, error) {
+	if request.Name == "" {
+		return Server{}, ValidationError("Agent name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var server Server
+	found := false
+	for _, candidate := range s.Servers {
+		if candidate.Name == request.Name || (request.Address != "" && candidate.Type == "agent" && candidate.IP == request.Address) {
+			server = candidate
+			found = true
+			break
+		}
+	}
+	switch {
+	case tokensEqual(token, s.token):
+	case found && tokensEqual(token, agentToken(s.token, server.IP)):
+	case found && server.Name == request.Name && s.useBootstrapToken(server.Name, token, registerUse):
+	default:
+		return Server{}, UnauthorizedError("Invalid token for server '%s'", request.Name)
+	}
+	if !found {
+		if request.Address == "" {
+			return Server{}, ValidationError("Agent address is required for servers the control plane doesn't know yet")
+		}
+		id, err := randomHex(3)
+		if err != nil {
+			return Server{}, err
+		}
+		server = Server{ID: fmt.Sprintf("%s%s", request.Name, id), Name: request.Name, Type: "agent", Status: "running"}
+		log.Printf("Agent on unknown server '%s' registered, adding it as '%s'", request.Name, server.ID)
+	}
+	if request.Address != "" && request.Address != server.IP {
+		if found && server.Type != "agent" {
+			log.Printf("Agent on server '%s' registered with address '%s', keeping '%s'", server.ID, request.Address, server.IP)
+		} else {
+			for _, other := range s.Servers {
+				if other.ID != server.ID && other.IP == request.Address {
+					return Server{}, ConflictError("Address '%s' belongs to server '%s'", request.Address, other.ID)
+				}
+			}
+			server.IP = request.Address
+		}
+	}
+	recovered := server.Status == "unreachable"
+	applyHeartbeat(&server, request.AgentHeartbeatRequest, time.Now().UTC())
+
+	if err := s.store.SaveServer(server); err != nil {
+		return Server{}, err
+	}
+	s.Servers[server.ID] = server
+	if recovered {
+		go deleteOrphanSandboxes(server)
+	}
+	s.sweepOrphanedSandboxes(server)
+
+	return server, nil
+}
+
+// Heartbeat records that a server's agent is alive. It's only persisted when
+// something other than the time of the heartbeat changed.
+func (s *ServerHandler) Heartbeat(ID string, request AgentHeartbeatRequest) (Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		return server, NotFoundError("Server not found with ID '%s'", ID)
+	}
+
+	previous := server
+	applyHeartbeat(&server, request, time.Now().UTC())
+	if server.Status != previous.Status || server.AgentVersion != previous.AgentVersion || server.Capacity != previous.Capacity || !slices.Equal(server.SandboxIDs, previous.SandboxIDs) {
+		if err := s.store.SaveServer(server); err != nil {
+			return Server{}, err
+		}
+	}
+	s.Servers[ID] = server
+	if previous.Status == "unreachable" {
+		go deleteOrphanSandboxes(server)
+	}
+	s.sweepOrphanedSandboxes(server)
+
+	return server, nil
+}
+
+func applyHeartbeat(server *Server, request AgentHeartbeatRequest, now time.Time) {
+	server.AgentVersion = request.Version
+	if request.Capacity.CPU > 0 && request.Capacity.MemoryMB > 0 {
+		server.Capacity = request.Capacity
+	}
+	server.SandboxIDs = request.SandboxIDs
+	server.LastHeartbeat = &now
+	switch server.Status {
+	case "provisioning", "deleting":
+		// CreateServer and DeleteServer own these
+	default:
+		if server.Status != "running" {
+			log.Printf("Agent on server '%s' is alive, marking it running", server.ID)
+		}
+		server.Status = "running"
+	}
+}
+
+// AgentMonitor detects dead servers: ones whose agent stopped sending
+// heartbeats (if it ever sent any) or failed UnhealthyThreshold health checks
+// in a row. It marks them unreachable and has their containers rescheduled.
+// A server whose agent answers again is marked running.
+type AgentMonitor struct {
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	started   time.Time
+	// failures counts consecutive failed health checks per server; only
+	// the Run goroutine touches it.
+	failures map[string]int
+}
+
+func NewAgentMonitor(config AgentConfig) *AgentMonitor {
+	return &AgentMonitor{
+		interval:  time.Duration(config.HeartbeatIntervalSeconds) * time.Second,
+		timeout:   time.Duration(config.HeartbeatTimeoutSeconds) * time.Second,
+		threshold: config.UnhealthyThreshold,
+		failures:  make(map[string]int),
+	}
+}
+
+func (m *AgentMonitor) Run(ctx context.Context) {
+	// Heartbeats recorded before a restart are stale; give every agent a
+	// full timeout to check in again.
+	m.started = time.Now()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.check(time.Now())
+	}
+}
+
+func (m *AgentMonitor) check(now time.Time) {
+	servers, err := serverHandler.ListServers()
+	if err != nil {
+		log.Printf("Agent monitor: %v", err)
+		return
+	}
+
+	health := m.probe(servers)
+	for _, server := range servers {
+		err, probed := health[server.ID]
+		switch {
+		case !probed:
+			delete(m.failures, server.ID)
+			continue
+		case err == nil:
+			delete(m.failures, server.ID)
+		default:
+			m.failures[server.ID]++
+		}
+
+		if server.Status == "unreachable" {
+			// Agents that heartbeat come back through their next heartbeat
+			if err == nil && server.LastHeartbeat == nil {
+				if err := serverHandler.markReachable(server.ID); err != nil {
+					log.Printf("Agent monitor: %v", err)
+				}
+			}
+			continue
+		}
+
+		switch {
+		case err != nil && m.failures[server.ID] >= m.threshold:
+			m.markDead(server, fmt.Sprintf("failed %d health checks in a row: %v", m.failures[server.ID], err))
+		case server.LastHeartbeat != nil && now.Sub(m.lastSeen(server)) >= m.timeout:
+			m.markDead(server, fmt.Sprintf("sent no heartbeat since %s", server.LastHeartbeat.Format(time.RFC3339)))
+		}
+	}
+}
+
+// lastSeen is the server's last heartbeat, or when the monitor started if
+// that was later.
+func (m *AgentMonitor) lastSeen(server Server) time.Time {
+	if server.LastHeartbeat.Before(m.started) {
+		return m.started
+	}
+	return *server.LastHeartbeat
+}
+
+// probe health checks the agents of running and unreachable servers in
+// parallel, so one hanging agent doesn't hold up the rest.
+func (m *AgentMonitor) probe(servers []Server) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error)
+	for _, server := range servers {
+		switch server.Status {
+		case "running", "online", "unreachable":
+		default:
+			continue
+		}
+		wg.Add(1)
+		go func(server Server) {
+			defer wg.Done()
+			err := sandboxClient.Health(server.IP)
+			mu.Lock()
+			results[server.ID] = err
+			mu.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *AgentMonitor) markDead(server Server, reason string) {
+	marked, err := serverHandler.markUnreachable(server.ID, server.LastHeartbeat)
+	if err != nil {
+		log.Printf("Agent monitor: %v", err)
+		return
+	}
+	if !marked {
+		return
+	}
+	log.Printf("Agent monitor: server '%s' %s, marked it unreachable", server.ID, reason)
+	if err := serviceHandler.RescheduleServerContainers(server.ID); err != nil {
+		log.Printf("Agent monitor: rescheduling containers of server '%s' failed: %v", server.ID, err)
+	}
+}
+
+// markUnreachable marks the server unreachable unless its status changed or
+// a heartbeat arrived after lastHeartbeat in the meantime.
+func (s *ServerHandler) markUnreachable(ID string, lastHeartbeat *time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		return false, NotFoundError("Server not found with ID '%s'", ID)
+	}
+	switch server.Status {
+	case "running", "online":
+	default:
+		return false, nil
+	}
+	if server.LastHeartbeat != nil && (lastHeartbeat == nil || !server.LastHeartbeat.Equal(*lastHeartbeat)) {
+		return false, nil
+	}
+	server.Status = "unreachable"
+	if err := s.store.SaveServer(server); err != nil {
+		return false, err
+	}
+	s.Servers[ID] = server
+	return true, nil
+}
+
+// markReachable brings an unreachable server whose agent answers again back
+// into scheduling.
+func (s *ServerHandler) markReachable(ID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		return NotFoundError("Server not found with ID '%s'", ID)
+	}
+	if server.Status != "unreachable" {
+		return nil
+	}
+	server.Status = "running"
+	if err := s.store.SaveServer(server); err != nil {
+		return err
+	}
+	s.Servers[ID] = server
+	log.Printf("Server '%s' answers its health check again, marking it running", ID)
+	go deleteOrphanSandboxes(server)
+	s.sweepOrphanedSandboxes(server)
+	return nil
+}
+
+// recordOrphanedSandbox remembers a sandbox on the server that no container
+// refers to any more, and deletes it right away if the server is up.
+func (s *ServerHandler) recordOrphanedSandbox(ID string, sandboxID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		// The sandbox went with its server
+		return nil
+	}
+	server.OrphanedSandboxIDs = append(server.OrphanedSandboxIDs, sandboxID)
+	if err := s.store.SaveServer(server); err != nil {
+		return err
+	}
+	s.Servers[ID] = server
+	s.sweepOrphanedSandboxes(server)
+	return nil
+}
+
+// sweepOrphanedSandboxes deletes the server's recorded orphaned sandboxes in
+// the background, if it is up and no sweep is under way already.
+// Callers hold s.mu.
+func (s *ServerHandler) sweepOrphanedSandboxes(server Server) {
+	switch server.Status {
+	case "running", "online":
+	default:
+		return
+	}
+	if len(server.OrphanedSandboxIDs) == 0 || s.sweeping[server.ID] {
+		return
+	}
+	s.sweeping[server.ID] = true
+	go func() {
+		for _, sandboxID := range server.OrphanedSandboxIDs {
+			if err := sandboxClient.DeleteSandbox(server.IP, sandboxID); err != nil && !IsNotFound(err) {
+				log.Printf("Deleting orphaned sandbox '%s' on server '%s' failed: %v", sandboxID, server.ID, err)
+				continue
+			}
+			log.Printf("Deleted sandbox '%s' on server '%s', its container was replaced while the server was unreachable", sandboxID, server.ID)
+			if err := s.forgetOrphanedSandbox(server.ID, sandboxID); err != nil {
+				log.Printf("Forgetting orphaned sandbox '%s' on server '%s' failed: %v", sandboxID, server.ID, err)
+			}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sweeping, server.ID)
+	}()
+}
+
+func (s *ServerHandler) forgetOrphanedSandbox(ID string, sandboxID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		return nil
+	}
+	server.OrphanedSandboxIDs = slices.DeleteFunc(slices.Clone(server.OrphanedSandboxIDs), func(ID string) bool { return ID == sandboxID })
+	if err := s.store.SaveServer(server); err != nil {
+		return err
+	}
+	s.Servers[ID] = server
+	return nil
+}
+
+// orphanWaitAttempts bounds how long deleteOrphanSandboxes waits, a second
+// at a time, for containers being placed on the server to be recorded.
+const orphanWaitAttempts = 30
+
+// deleteOrphanSandboxes deletes the sandboxes on a server that came back
+// which no container refers to: while it was unreachable its containers were
+// replaced elsewhere and forgotten, but their sandboxes may still be running.
+func deleteOrphanSandboxes(server Server) {
+	sandboxes, err := sandboxClient.ListSandboxes(server.IP)
+	if err != nil {
+		log.Printf("Listing sandboxes on recovered server '%s' failed: %v", server.ID, err)
+		return
+	}
+	if err := serviceHandler.recoverLostContainers(server.ID, sandboxes); err != nil {
+		log.Printf("Recovering lost containers on server '%s' failed: %v", server.ID, err)
+	}
+	// A sandbox listed above whose container is still being created is
+	// only recorded once its placement is released
+	for attempt := 0; scheduler.placing(server.ID); attempt++ {
+		if attempt == orphanWaitAttempts {
+			log.Printf("Containers are still being placed on recovered server '%s', leaving its sandboxes be", server.ID)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	containers, err := serviceHandler.ListAllContainers()
+	if err != nil {
+		log.Printf("Looking for orphaned sandboxes on server '%s' failed: %v", server.ID, err)
+		return
+	}
+	known := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		known[container.SandboxID] = true
+	}
+
+	for _, sandbox := range sandboxes {
+		if known[sandbox.ID] {
+			continue
+		}
+		log.Printf("Deleting sandbox '%s' on recovered server '%s', no container refers to it any more", sandbox.ID, server.ID)
+		if err := sandboxClient.DeleteSandbox(server.IP, sandbox.ID); err != nil && !IsNotFound(err) {
+			log.Printf("Deleting orphaned sandbox '%s' on server '%s' failed: %v", sandbox.ID, server.ID, err)
+		}
+	}
+}
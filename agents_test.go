@@ -0,0 +1,259 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecoveredServerLosesOrphanedSandboxes(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := serverHandler.GetServer(lost.ServerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server drops out, and one container is replaced elsewhere and
+	// forgotten while the other is still waiting for a new home
+	if _, err := serverHandler.markUnreachable(server.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lostContainer := service.Containers[lost.ID]
+	lostContainer.Status = containerLost
+	service.Containers[lost.ID] = lostContainer
+	if _, err := service.replaceLostContainer(lost.ID); err != nil {
+		t.Fatal(err)
+	}
+	keptContainer := service.Containers[kept.ID]
+	keptContainer.Status = containerLost
+	service.Containers[kept.ID] = keptContainer
+	if err := serviceHandler.SaveService(service); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serverHandler.setStatus(server.ID, "running"); err != nil {
+		t.Fatal(err)
+	}
+	deleteOrphanSandboxes(server)
+
+	if _, err := fake.GetSandbox(server.IP, lost.SandboxID); !IsNotFound(err) {
+		t.Errorf("orphaned sandbox of the replaced container is still there: %v", err)
+	}
+	if _, err := fake.GetSandbox(server.IP, kept.SandboxID); err != nil {
+		t.Errorf("sandbox of the container still recorded there was deleted: %v", err)
+	}
+	if count := fake.sandboxCount(); count != 2 {
+		t.Errorf("agents have %d sandboxes, want the kept one and the replacement", count)
+	}
+}
+
+func TestRecoveredServerGetsLostContainersBack(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := serverHandler.GetServer(replaced.ServerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both are lost, and one is replaced while the server is unreachable
+	if _, err := serverHandler.markUnreachable(server.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, container := range []Container{replaced, kept} {
+		container = service.Containers[container.ID]
+		container.Status = containerLost
+		service.Containers[container.ID] = container
+	}
+	if _, err := service.replaceLostContainer(replaced.ID); err != nil {
+		t.Fatal(err)
+	}
+	if server, _ := serverHandler.GetServer(server.ID); len(server.OrphanedSandboxIDs) != 1 || server.OrphanedSandboxIDs[0] != replaced.SandboxID {
+		t.Fatalf("server records orphaned sandboxes %v, want the replaced container's", server.OrphanedSandboxIDs)
+	}
+
+	// The server comes back: the kept container is found again, and the
+	// recorded sandbox is deleted with the next heartbeat
+	if err := serverHandler.setStatus(server.ID, "running"); err != nil {
+		t.Fatal(err)
+	}
+	if err := serviceHandler.recoverLostContainers(server.ID, []Sandbox{{ID: kept.SandboxID, Status: "running"}}); err != nil {
+		t.Fatal(err)
+	}
+	if service, _ := serviceHandler.GetService(service.ID); service.Containers[kept.ID].Status != "running" {
+		t.Errorf("kept container is '%s', want running", service.Containers[kept.ID].Status)
+	}
+	if _, err := serverHandler.Heartbeat(server.ID, AgentHeartbeatRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		server, _ := serverHandler.GetServer(server.ID)
+		if len(server.OrphanedSandboxIDs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server still records orphaned sandboxes %v", server.OrphanedSandboxIDs)
+		}
+	}
+	if _, err := fake.GetSandbox(server.IP, replaced.SandboxID); !IsNotFound(err) {
+		t.Errorf("sandbox of the replaced container is still there: %v", err)
+	}
+}
+
+func TestSandboxOfContainerReplacedAfterRecoveryIsDeleted(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := serverHandler.GetServer(lost.ServerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is back, but the reconciler replaces the container before
+	// the recovery catches up with it
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := service.Containers[lost.ID]
+	container.Status = containerLost
+	service.Containers[lost.ID] = container
+	if _, err := service.replaceLostContainer(lost.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := fake.GetSandbox(server.IP, lost.SandboxID)
+		if IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sandbox of the replaced container is still there: %v", err)
+		}
+	}
+}
+
+func TestAgentRegistersWithItsServersToken(t *testing.T) {
+	newTestCluster(t)
+	tokens := recordBootstrapTokens()
+	for _, name := range []string{"jcs-a", "jcs-b"} {
+		if _, err := serverHandler.CreateServer(name, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register := func(name string, token string) (Server, error) {
+		request := AgentRegisterRequest{Name: name}
+		if name == "by-hand" {
+			request.Address = "10.0.0.9:8080"
+		}
+		return serverHandler.RegisterAgent(request, token)
+	}
+
+	if _, err := register("jcs-a", tokens["jcs-b"]); KindOf(err) != ErrUnauthorized {
+		t.Errorf("registering with another server's bootstrap token: %v, want unauthorized", err)
+	}
+	server, err := register("jcs-a", tokens["jcs-a"])
+	if err != nil {
+		t.Fatalf("registering with the server's bootstrap token: %v", err)
+	}
+	if _, err := register("jcs-a", tokens["jcs-a"]); KindOf(err) != ErrUnauthorized {
+		t.Errorf("registering with the bootstrap token a second time: %v, want unauthorized", err)
+	}
+
+	// From then on the agent uses the token it was issued
+	issued := agentToken(serverHandler.token, server.IP)
+	if _, err := register("jcs-a", issued); err != nil {
+		t.Errorf("registering again with the agent token: %v", err)
+	}
+	if err := serverHandler.AuthorizeAgent(server.ID, issued); err != nil {
+		t.Errorf("heartbeat with the agent token: %v", err)
+	}
+	if err := serverHandler.AuthorizeAgent(server.ID, tokens["jcs-a"]); KindOf(err) != ErrUnauthorized {
+		t.Errorf("heartbeat with the bootstrap token: %v, want unauthorized", err)
+	}
+
+	// Agents started by hand register with the shared token
+	if _, err := register("by-hand", "wrong"); KindOf(err) != ErrUnauthorized {
+		t.Errorf("registering a new agent with a wrong token: %v, want unauthorized", err)
+	}
+	if _, err := register("by-hand", serverHandler.token); err != nil {
+		t.Errorf("registering a new agent with the shared token: %v", err)
+	}
+}
+
+func TestAgentCannotMoveProviderServers(t *testing.T) {
+	newTestCluster(t)
+	created, err := serverHandler.CreateServer("jcs-a", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not even with its own token
+	server, err := serverHandler.RegisterAgent(AgentRegisterRequest{Name: "jcs-a", Address: "10.6.6.6:80"}, agentToken(serverHandler.token, created.IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.IP != created.IP {
+		t.Errorf("provider server moved to '%s', want '%s'", server.IP, created.IP)
+	}
+
+	// An agent claiming the server's address doesn't take it over
+	_, err = serverHandler.RegisterAgent(AgentRegisterRequest{Name: "impostor", Address: created.IP}, serverHandler.token)
+	if KindOf(err) != ErrConflict {
+		t.Errorf("registering with a provider server's address: %v, want conflict", err)
+	}
+	if server, _ := serverHandler.GetServer(created.ID); server.Name != "jcs-a" || server.IP != created.IP {
+		t.Errorf("provider server is now '%s' at '%s'", server.Name, server.IP)
+	}
+
+	// Agents that added themselves can move, with their agent token
+	added, err := serverHandler.RegisterAgent(AgentRegisterRequest{Name: "by-hand", Address: "10.0.0.9:8080"}, serverHandler.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverHandler.RegisterAgent(AgentRegisterRequest{Name: "by-hand", Address: "10.0.0.10:8080"}, "wrong"); KindOf(err) != ErrUnauthorized {
+		t.Errorf("moving with a wrong token: %v, want unauthorized", err)
+	}
+	moved, err := serverHandler.RegisterAgent(AgentRegisterRequest{Name: "by-hand", Address: "10.0.0.10:8080"}, agentToken(serverHandler.token, added.IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ID != added.ID || moved.IP != "10.0.0.10:8080" {
+		t.Errorf("agent re-registered as '%s' at '%s', want '%s' at the new address", moved.ID, moved.IP, added.ID)
+	}
+}
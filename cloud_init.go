@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+// defaultUserDataTemplate bootstraps a plain Ubuntu server: it installs the
+// container runtime and the sandbox agent (cmd/jcs-agent, running sandboxes as
+// docker containers), authorizes our SSH keys, and phones home with the
+// server's SSH host keys once everything is up. cloud-init's own phone_home
+// can't send headers, so a script posts the keys with the bootstrap token in
+// an Authorization header, keeping it out of URLs and request logs.
+const defaultUserDataTemplate = `#cloud-config
+hostname: {{quote .ServerName}}
+package_update: true
+packages:
+  - docker.io
+  - curl
+{{- if .SSHAuthorizedKeys}}
+ssh_authorized_keys:
+{{- range .SSHAuthorizedKeys}}
+  - {{quote .}}
+{{- end}}
+{{- end}}
+write_files:
+  - path: /etc/jcs-agent.env
+    permissions: "0600"
+    content: |
+      JCS_AGENT_RUNTIME=docker
+      JCS_AGENT_NAME={{.ServerName}}
+      JCS_BOOTSTRAP_TOKEN={{.Token}}
+{{- if .ControlPlaneURL}}
+      JCS_CONTROL_PLANE_URL={{.ControlPlaneURL}}
+{{- end}}
+  - path: /etc/systemd/system/jcs-agent.service
+    content: |
+      [Unit]
+      Description=jcs sandbox agent
+      After=network-online.target docker.service
+      Wants=network-online.target
+
+      [Service]
+      EnvironmentFile=/etc/jcs-agent.env
+      ExecStart=/usr/local/bin/jcs-agent
+      Restart=always
+
+      [Install]
+      WantedBy=multi-user.target
+{{- if .PhoneHomeURL}}
+  - path: /usr/local/sbin/jcs-phone-home
+    permissions: "0700"
+    content: |
+      #!/bin/sh
+      . /etc/jcs-agent.env
+      set --
+      for type in rsa ecdsa ed25519; do
+        if [ -f /etc/ssh/ssh_host_${type}_key.pub ]; then
+          set -- "$@" --data-urlencode "pub_key_${type}@/etc/ssh/ssh_host_${type}_key.pub"
+        fi
+      done
+      exec curl -fsS --retry 10 --retry-all-errors -o /dev/null \
+        -H "Authorization: Bearer $JCS_BOOTSTRAP_TOKEN" \
+        --data-urlencode "hostname=$(hostname)" "$@" \
+        {{quote .PhoneHomeURL}}
+{{- end}}
+runcmd:
+  - systemctl enable --now docker
+  - curl -fsSL -o /usr/local/bin/jcs-agent {{quote .AgentURL}}
+  - chmod +x /usr/local/bin/jcs-agent
+  - systemctl daemon-reload
+  - systemctl enable --now jcs-agent
+{{- if .PhoneHomeURL}}
+  - /usr/local/sbin/jcs-phone-home
+{{- end}}
+`
+
+// UserDataParams is what a cloud-init template is rendered with.
+type UserDataParams struct {
+	ServerName        string
+	ServerType        string
+	AgentURL          string
+	SSHAuthorizedKeys []string
+	// ControlPlaneURL is what the agent registers with, empty when none is
+	// configured. Token is the server's own bootstrap token, good for one
+	// phone home and one registration; anything on the server can read the
+	// user data, so it must never be the shared token.
+	ControlPlaneURL string
+	Token           string
+	// PhoneHomeURL is empty when no control plane URL is configured. It
+	// takes the server's SSH host keys as a form post, authenticated with
+	// "Authorization: Bearer <Token>".
+	PhoneHomeURL string
+}
+
+// renderUserData builds the cloud-init user_data for a new server, using the
+// template configured for its server type, then the "default" one, then the
+// built-in template. token is the server's bootstrap token.
+func renderUserData(config BootstrapConfig, name string, serverType string, token string) (string, error) {
+	text := defaultUserDataTemplate
+	path, ok := config.Templates[serverType]
+	if !ok {
+		path = config.Templates["default"]
+	}
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Error reading cloud-init template '%s': %v", path, err)
+		}
+		text = string(contents)
+	}
+
+	tmpl, err := template.New("user_data").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing cloud-init template for server type '%s': %v", serverType, err)
+	}
+
+	params := UserDataParams{
+		ServerName:        name,
+		ServerType:        serverType,
+		AgentURL:          config.AgentURL,
+		SSHAuthorizedKeys: config.SSHAuthorizedKeys,
+		Token:             token,
+	}
+	if config.ControlPlaneURL != "" {
+		params.ControlPlaneURL = config.ControlPlaneURL
+		params.PhoneHomeURL = fmt.Sprintf("%s/api/servers/phone-home/%s", config.ControlPlaneURL, url.PathEscape(name))
+	}
+
+	var userData bytes.Buffer
+	if err := tmpl.Execute(&userData, params); err != nil {
+		return "", fmt.Errorf("Error rendering cloud-init template for server type '%s': %v", serverType, err)
+	}
+	return userData.String(), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUserDataKeepsTokenOutOfURLs(t *testing.T) {
+	config := BootstrapConfig{ControlPlaneURL: "https://jcs.example.com", Token: "s3cret", AgentURL: "https://example.com/jcs-agent"}
+	userData, err := renderUserData(config, "jcs-abc", "cpx21", "one-time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(userData, "token=") {
+		t.Errorf("user data passes the token in a URL:\n%s", userData)
+	}
+	// Anything on the server can read its user data
+	if strings.Contains(userData, "s3cret") {
+		t.Errorf("user data holds the shared token:\n%s", userData)
+	}
+	for _, want := range []string{
+		"JCS_BOOTSTRAP_TOKEN=one-time",
+		`-H "Authorization: Bearer $JCS_BOOTSTRAP_TOKEN"`,
+		`"https://jcs.example.com/api/servers/phone-home/jcs-abc"`,
+		"  - /usr/local/sbin/jcs-phone-home",
+	} {
+		if !strings.Contains(userData, want) {
+			t.Errorf("user data is missing %q:\n%s", want, userData)
+		}
+	}
+}
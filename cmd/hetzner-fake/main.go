@@ -0,0 +1,24 @@
+// Command hetzner-fake serves the fake Hetzner Cloud API, so the control plane
+// can run with provider "hetzner" and hetzner.base_url pointed at it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"jcs/internal/hetznerfake"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8090", "address to listen on")
+	token := flag.String("token", "fake", "API token clients must send")
+	actionPolls := flag.Int("action-polls", 2, "polls before an action succeeds")
+	flag.Parse()
+
+	fake := hetznerfake.New(*token)
+	fake.ActionPolls = *actionPolls
+
+	log.Printf("Fake Hetzner API on http://%s/v1", *addr)
+	log.Fatal(http.ListenAndServe(*addr, fake))
+}
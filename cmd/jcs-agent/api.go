@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type SandboxExecRequest struct {
+	Command string `json:"command"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// newRouter serves the sandbox API the control plane's HTTPSandboxClient
+// calls, and proxies /sandboxes/{id}/ to each sandbox's port for previews.
+// publicHost overrides the host preview URLs are built from; by default it is
+// whatever host the control plane reached us on. The API other than the
+// health check needs the token expected returns for the request as a bearer
+// token; previews stay public.
+func newRouter(manager *Manager, publicHost string, expected func(r *http.Request) string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+
+	host := func(r *http.Request) string {
+		if publicHost != "" {
+			return publicHost
+		}
+		return r.Host
+	}
+
+	r.Get("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(requireToken(expected))
+
+		r.Route("/api/sandboxes", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				sandboxes, err := manager.List()
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnJSON(w, http.StatusOK, sandboxes)
+			})
+
+			r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+				data := SandboxCreateRequest{}
+				if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+					returnError(w, validationError("Invalid request body"))
+					return
+				}
+				sandbox, err := manager.Create(data, host(req))
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnJSON(w, http.StatusCreated, sandbox)
+			})
+
+			r.Route("/{id}", func(r chi.Router) {
+				r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+					sandbox, err := manager.Get(chi.URLParam(r, "id"))
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					returnJSON(w, http.StatusOK, sandbox)
+				})
+
+				r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+					if err := manager.Delete(chi.URLParam(r, "id")); err != nil {
+						returnError(w, err)
+						return
+					}
+					w.WriteHeader(http.StatusNoContent)
+				})
+
+				actions := map[string]func(ID string) (Sandbox, error){
+					"stop":    manager.Stop,
+					"start":   manager.Start,
+					"restart": manager.Restart,
+				}
+				for name, action := range actions {
+					r.Post("/"+name, func(w http.ResponseWriter, r *http.Request) {
+						sandbox, err := action(chi.URLParam(r, "id"))
+						if err != nil {
+							returnError(w, err)
+							return
+						}
+						returnJSON(w, http.StatusOK, sandbox)
+					})
+				}
+
+				r.Get("/logs", func(w http.ResponseWriter, r *http.Request) {
+					logs, err := manager.Logs(chi.URLParam(r, "id"))
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					w.Write([]byte(logs))
+				})
+
+				r.Post("/exec", func(w http.ResponseWriter, r *http.Request) {
+					data := SandboxExecRequest{}
+					if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+						returnError(w, validationError("Invalid request body"))
+						return
+					}
+					result, err := manager.Exec(chi.URLParam(r, "id"), data.Command)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					returnJSON(w, http.StatusOK, result)
+				})
+			})
+		})
+
+		r.Route("/api/volumes", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				volumes, err := manager.ListVolumes()
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnJSON(w, http.StatusOK, volumes)
+			})
+
+			r.Delete("/{name}", func(w http.ResponseWriter, r *http.Request) {
+				if err := manager.DeleteVolume(chi.URLParam(r, "name")); err != nil {
+					returnError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+	})
+
+	// ReverseProxy handles websocket upgrades itself, so the same route
+	// serves the preview and websocket URLs
+	r.HandleFunc("/sandboxes/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+		ID := chi.URLParam(r, "id")
+		port, err := manager.Port(ID)
+		if err != nil {
+			returnError(w, err)
+			return
+		}
+		target := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.Out.URL.Path = "/" + chi.URLParam(r, "*")
+				pr.Out.URL.RawPath = ""
+				pr.SetXForwarded()
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				returnErrorResponse(w, fmt.Sprintf("Sandbox '%s' is not accepting connections: %v", ID, err), http.StatusBadGateway)
+			},
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	return r
+}
+
+// requireToken rejects requests that don't carry "Authorization: Bearer
+// <token>", where token is what expected returns for the request. An empty
+// token, as before the agent has registered, rejects everything.
+func requireToken(expected func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !tokensEqual(expected(r), presented) {
+				returnErrorResponse(w, "Invalid or missing token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func returnJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func returnError(w http.ResponseWriter, err error) {
+	var agentErr *agentError
+	if errors.As(err, &agentErr) {
+		returnErrorResponse(w, agentErr.message, agentErr.status)
+		return
+	}
+	log.Printf("Error: %v", err)
+	returnErrorResponse(w, err.Error(), http.StatusInternalServerError)
+}
+
+func returnErrorResponse(w http.ResponseWriter, message string, status int) {
+	returnJSON(w, status, ErrorResponse{Message: message})
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+func diskMB(dir string) int {
+	return 0
+}
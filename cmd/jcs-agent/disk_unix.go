@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// diskMB reports the size of the filesystem dir is on, or zero if it can't
+// be read.
+func diskMB(dir string) int {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0
+	}
+	return int(uint64(stat.Blocks) * uint64(stat.Bsize) / (1 << 20))
+}
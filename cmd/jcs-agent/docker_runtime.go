@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DockerRuntime runs each sandbox as a container through the docker CLI. The
+// container publishes $PORT on localhost for the agent's preview proxy.
+type DockerRuntime struct {
+	docker string
+}
+
+func NewDockerRuntime() (Runtime, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, fmt.Errorf("The docker runtime needs the docker CLI: %v", err)
+	}
+	return &DockerRuntime{docker: docker}, nil
+}
+
+func containerName(spec SandboxSpec) string {
+	return "jcs-" + spec.ID
+}
+
+func (d *DockerRuntime) Start(spec SandboxSpec) error {
+	// Restart the existing container if there is one, so its filesystem
+	// survives a stop and start like a process sandbox's directory does
+	if _, err := d.run("container", "inspect", containerName(spec)); err == nil {
+		_, err := d.run("start", containerName(spec))
+		return err
+	}
+
+	port := strconv.Itoa(spec.Port)
+	args := []string{
+		"run", "--detach",
+		"--name", containerName(spec),
+		"--label", "jcs.sandbox=" + spec.ID,
+		"--env", "PORT=" + port,
+		"--publish", fmt.Sprintf("127.0.0.1:%s:%s", port, port),
+	}
+	limits := spec.Resources
+	if limits.CPU > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(limits.CPU, 'f', -1, 64))
+	}
+	if limits.MemoryMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", limits.MemoryMB))
+	}
+	if limits.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(limits.Pids))
+	}
+	// The environment goes in a file rather than on the command line, where
+	// anyone can see it, or in the docker CLI's own environment, where
+	// variables like DOCKER_HOST would change what the CLI does
+	envFile, err := writeEnvFile(spec.Env)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(envFile)
+	args = append(args, "--env-file", envFile)
+	for _, mount := range spec.Mounts {
+		args = append(args, "--volume", mount.Source+":"+mount.Path)
+	}
+	if limits.DiskMB > 0 {
+		// Only some storage drivers support this; docker refuses to start
+		// the container otherwise rather than run it without the limit
+		args = append(args, "--storage-opt", fmt.Sprintf("size=%dm", limits.DiskMB))
+	}
+	args = append(args, spec.ImageName)
+	if spec.StartCommand != "" {
+		args = append(args, "/bin/sh", "-c", spec.StartCommand)
+	}
+	_, err = d.run(args...)
+	return err
+}
+
+func (d *DockerRuntime) Stop(spec SandboxSpec, grace time.Duration) error {
+	_, err := d.run("stop", "--time", strconv.Itoa(int(grace.Seconds())), containerName(spec))
+	if isNoSuchContainer(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DockerRuntime) Remove(spec SandboxSpec) error {
+	_, err := d.run("rm", "--force", containerName(spec))
+	if isNoSuchContainer(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DockerRuntime) State(spec SandboxSpec) (RuntimeState, error) {
+	output, err := d.run("container", "inspect", "--format", "{{.State.Running}} {{.State.ExitCode}}", containerName(spec))
+	if isNoSuchContainer(err) {
+		return RuntimeState{ExitCode: -1}, nil
+	}
+	if err != nil {
+		return RuntimeState{}, err
+	}
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return RuntimeState{}, fmt.Errorf("Unexpected docker inspect output '%s'", output)
+	}
+	exitCode, _ := strconv.Atoi(fields[1])
+	return RuntimeState{Running: fields[0] == "true", ExitCode: exitCode}, nil
+}
+
+func (d *DockerRuntime) Logs(spec SandboxSpec) (string, error) {
+	cmd := exec.Command(d.docker, "logs", "--tail", "10000", containerName(spec))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker logs: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return string(output), nil
+}
+
+func (d *DockerRuntime) Exec(spec SandboxSpec, command string, timeout time.Duration) (ExecResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, d.docker, "exec", containerName(spec), "/bin/sh", "-c", command)
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return ExecResult{ExitCode: exitErr.ExitCode(), Output: string(output)}, nil
+	case err != nil:
+		return ExecResult{}, err
+	}
+	return ExecResult{Output: string(output)}, nil
+}
+
+// run runs a docker command and returns its trimmed stdout.
+func (d *DockerRuntime) run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(d.docker, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// writeEnvFile writes env to a file only the agent's user can read, in the
+// format docker's --env-file takes. Callers remove it once docker has read it.
+func writeEnvFile(env map[string]string) (string, error) {
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		// The format has no way to escape one
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("Environment variable '%s' contains a line break, which the docker runtime can't pass on", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var contents strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&contents, "%s=%s\n", name, env[name])
+	}
+
+	file, err := os.CreateTemp("", "jcs-env-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(contents.String()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func isNoSuchContainer(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "No such container")
+}
@@ -0,0 +1,119 @@
+// Command jcs-agent is the reference sandbox agent: it runs on each server and
+// serves the sandbox API the control plane schedules containers through.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// version is reported to the control plane; release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	hostname, _ := os.Hostname()
+
+	listen := flag.String("listen", envOr("JCS_AGENT_LISTEN", ":80"), "address to serve the sandbox API on")
+	runtimeName := flag.String("runtime", envOr("JCS_AGENT_RUNTIME", "process"), "sandbox runtime: process or docker")
+	dataDir := flag.String("data-dir", envOr("JCS_AGENT_DATA_DIR", "/var/lib/jcs-agent"), "directory sandboxes are kept in")
+	publicHost := flag.String("public-host", os.Getenv("JCS_AGENT_PUBLIC_HOST"), "host[:port] preview URLs point at (default: the host requests arrive on)")
+	controlPlane := flag.String("control-plane", os.Getenv("JCS_CONTROL_PLANE_URL"), "control plane URL to register with (default: don't register)")
+	token := flag.String("token", os.Getenv("JCS_BOOTSTRAP_TOKEN"), "token to register with the control plane with; without -control-plane, the shared token the control plane derives this agent's API token from")
+	apiTokenFlag := flag.String("api-token", os.Getenv("JCS_AGENT_TOKEN"), "token the control plane presents to the API (default: the one it issues when the agent registers)")
+	name := flag.String("name", envOr("JCS_AGENT_NAME", hostname), "server name to register as")
+	address := flag.String("address", os.Getenv("JCS_AGENT_ADDRESS"), "host[:port] the control plane should reach this agent on (default: the address it already knows)")
+	sandboxPorts := flag.String("sandbox-ports", envOr("JCS_AGENT_SANDBOX_PORTS", "20000-29999"), "range of local ports sandboxes listen on")
+	flag.Parse()
+
+	var firstPort, lastPort int
+	if _, err := fmt.Sscanf(*sandboxPorts, "%d-%d", &firstPort, &lastPort); err != nil || firstPort < 1 || lastPort > 65535 || firstPort > lastPort {
+		log.Fatalf("Invalid sandbox port range '%s', expected FIRST-LAST", *sandboxPorts)
+	}
+
+	runtime, err := NewRuntime(*runtimeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manager, err := NewManager(*dataDir, runtime, firstPort, lastPort)
+	if err != nil {
+		log.Fatalf("Error loading sandboxes from '%s': %v", *dataDir, err)
+	}
+
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	if *token == "" && *apiTokenFlag == "" {
+		log.Fatal("A token (-token or JCS_BOOTSTRAP_TOKEN, or -api-token or JCS_AGENT_TOKEN) is required to serve the sandbox API")
+	}
+	apiToken, err := loadAPIToken(filepath.Join(*dataDir, "api-token"))
+	if err != nil {
+		log.Fatalf("Error loading the agent token: %v", err)
+	}
+	if *apiTokenFlag != "" {
+		apiToken.value = *apiTokenFlag
+	}
+	// An agent started by hand without a control plane to issue it a token
+	// expects the one the control plane derives for the host it reaches it on
+	expected := func(r *http.Request) string {
+		if value := apiToken.Get(); value != "" || *controlPlane != "" {
+			return value
+		}
+		return agentToken(*token, r.Host)
+	}
+	if *controlPlane != "" {
+		registrar := &Registrar{
+			controlPlaneURL: *controlPlane,
+			bootstrapToken:  *token,
+			apiToken:        apiToken,
+			name:            *name,
+			address:         *address,
+			manager:         manager,
+			client:          &http.Client{Timeout: 10 * time.Second},
+		}
+		go registrar.Run(background)
+	}
+
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: newRouter(manager, *publicHost, expected),
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		log.Printf("Sandbox agent %s listening on %s with the %s runtime", version, *listen, *runtimeName)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	<-sigChan
+	log.Println("Shutdown signal received, shutting down gracefully...")
+	stopBackground()
+
+	// Sandboxes are left running. A restarted agent reports process
+	// sandboxes as exited and kills the leftovers when they are restarted
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+	log.Println("Server exited")
+}
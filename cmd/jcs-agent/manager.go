@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sandbox is what the agent reports to the control plane. A sandbox is
+// "stopped" after being asked to stop and "exited" when its workload ended on
+// its own, which the control plane treats as a crash.
+type Sandbox struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	PreviewURL   string `json:"preview_url"`
+	WebsocketURL string `json:"websocket_url"`
+	ExitCode     *int   `json:"exit_code,omitempty"`
+}
+
+type SandboxCreateRequest struct {
+	ImageName    string            `json:"image_name"`
+	StartCommand string            `json:"start_command,omitempty"`
+	Resources    Resources         `json:"resources,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Mounts       []MountRequest    `json:"mounts,omitempty"`
+}
+
+// MountRequest mounts a volume at Path. HostPath is where the volume is
+// already mounted on this machine; without one the agent keeps the volume
+// as a directory under its data directory.
+type MountRequest struct {
+	Volume   string `json:"volume"`
+	HostPath string `json:"host_path,omitempty"`
+	Path     string `json:"path"`
+}
+
+// Volume is a volume the agent keeps in its data directory.
+type Volume struct {
+	Name string `json:"name"`
+	// Sandboxes are the sandboxes mounting the volume.
+	Sandboxes []string `json:"sandboxes"`
+}
+
+var volumeNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// sandboxRecord is persisted as sandbox.json in the sandbox's directory so the
+// agent remembers its sandboxes across restarts. Only the agent's user may
+// read it, since the environment may hold secrets.
+type sandboxRecord struct {
+	SandboxSpec
+	// Host is the address the control plane reached us on, used for the
+	// preview URLs.
+	Host      string    `json:"host"`
+	Stopped   bool      `json:"stopped"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// mu serializes lifecycle changes to this sandbox.
+	mu sync.Mutex
+}
+
+// agentError carries the HTTP status the API answers with.
+type agentError struct {
+	status  int
+	message string
+}
+
+func (e *agentError) Error() string {
+	return e.message
+}
+
+func notFoundError(format string, args ...any) error {
+	return &agentError{status: http.StatusNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+func validationError(format string, args ...any) error {
+	return &agentError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+func conflictError(format string, args ...any) error {
+	return &agentError{status: http.StatusConflict, message: fmt.Sprintf(format, args...)}
+}
+
+const (
+	stopGracePeriod = 10 * time.Second
+	execTimeout     = 60 * time.Second
+)
+
+type Manager struct {
+	mu      sync.Mutex
+	dataDir string
+	runtime Runtime
+	// Sandboxes get ports from firstPort to lastPort, so agents sharing a
+	// machine can be given ranges that don't overlap.
+	firstPort int
+	lastPort  int
+	sandboxes map[string]*sandboxRecord
+}
+
+// NewManager loads the sandboxes recorded under dataDir. Their workloads
+// didn't survive an agent restart, so they report as exited until the
+// control plane restarts them.
+func NewManager(dataDir string, runtime Runtime, firstPort int, lastPort int) (*Manager, error) {
+	m := &Manager{
+		dataDir:   dataDir,
+		runtime:   runtime,
+		firstPort: firstPort,
+		lastPort:  lastPort,
+		sandboxes: make(map[string]*sandboxRecord),
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, "sandboxes"), 0o755); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dataDir, "sandboxes", "*", "sandbox.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		record := &sandboxRecord{}
+		if err := json.Unmarshal(contents, record); err != nil {
+			log.Printf("Skipping unreadable sandbox record '%s': %v", path, err)
+			continue
+		}
+		record.Dir = filepath.Dir(path)
+		m.sandboxes[record.ID] = record
+	}
+	return m, nil
+}
+
+func (m *Manager) Create(request SandboxCreateRequest, host string) (Sandbox, error) {
+	if request.ImageName == "" {
+		return Sandbox{}, validationError("Image name is required")
+	}
+	limits := request.Resources
+	if limits.CPU < 0 || limits.MemoryMB < 0 || limits.DiskMB < 0 || limits.Pids < 0 {
+		return Sandbox{}, validationError("Resources must not be negative")
+	}
+	if _, ok := request.Env["PORT"]; ok {
+		return Sandbox{}, validationError("PORT is set by the agent")
+	}
+	mounts, err := m.mounts(request.Mounts)
+	if err != nil {
+		return Sandbox{}, err
+	}
+
+	m.mu.Lock()
+	id, err := randomHex(6)
+	if err != nil {
+		m.mu.Unlock()
+		return Sandbox{}, err
+	}
+	port, err := m.freePort()
+	if err != nil {
+		m.mu.Unlock()
+		return Sandbox{}, err
+	}
+	record := &sandboxRecord{
+		SandboxSpec: SandboxSpec{
+			ID:           id,
+			ImageName:    request.ImageName,
+			StartCommand: request.StartCommand,
+			Resources:    limits,
+			Env:          request.Env,
+			Mounts:       mounts,
+			Port:         port,
+			Dir:          filepath.Join(m.dataDir, "sandboxes", id),
+		},
+		Host:      host,
+		CreatedAt: time.Now().UTC(),
+	}
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	m.sandboxes[id] = record
+	m.mu.Unlock()
+
+	if err := os.MkdirAll(record.Dir, 0o755); err == nil {
+		err = record.save()
+	}
+	if err == nil {
+		err = m.runtime.Start(record.SandboxSpec)
+	}
+	if err != nil {
+		m.runtime.Remove(record.SandboxSpec)
+		os.RemoveAll(record.Dir)
+		m.mu.Lock()
+		delete(m.sandboxes, id)
+		m.mu.Unlock()
+		return Sandbox{}, err
+	}
+	log.Printf("Created sandbox '%s' on port %d", id, port)
+
+	return m.sandbox(record)
+}
+
+func (m *Manager) Get(ID string) (Sandbox, error) {
+	record, err := m.lookup(ID)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	return m.sandbox(record)
+}
+
+func (m *Manager) List() ([]Sandbox, error) {
+	m.mu.Lock()
+	records := make([]*sandboxRecord, 0, len(m.sandboxes))
+	for _, record := range m.sandboxes {
+		records = append(records, record)
+	}
+	m.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+
+	sandboxes := make([]Sandbox, 0, len(records))
+	for _, record := range records {
+		record.mu.Lock()
+		sandbox, err := m.sandbox(record)
+		record.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		sandboxes = append(sandboxes, sandbox)
+	}
+	return sandboxes, nil
+}
+
+// IDs lists the sandboxes this agent knows, for heartbeats.
+func (m *Manager) IDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.sandboxes))
+	for id := range m.sandboxes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (m *Manager) Stop(ID string) (Sandbox, error) {
+	return m.change(ID, func(record *sandboxRecord) error {
+		if err := m.runtime.Stop(record.SandboxSpec, stopGracePeriod); err != nil {
+			return err
+		}
+		record.Stopped = true
+		return record.save()
+	})
+}
+
+func (m *Manager) Start(ID string) (Sandbox, error) {
+	return m.change(ID, func(record *sandboxRecord) error {
+		state, err := m.runtime.State(record.SandboxSpec)
+		if err != nil {
+			return err
+		}
+		if !state.Running {
+			if err := m.runtime.Start(record.SandboxSpec); err != nil {
+				return err
+			}
+		}
+		record.Stopped = false
+		return record.save()
+	})
+}
+
+func (m *Manager) Restart(ID string) (Sandbox, error) {
+	return m.change(ID, func(record *sandboxRecord) error {
+		if err := m.runtime.Stop(record.SandboxSpec, stopGracePeriod); err != nil {
+			return err
+		}
+		if err := m.runtime.Start(record.SandboxSpec); err != nil {
+			return err
+		}
+		record.Stopped = false
+		return record.save()
+	})
+}
+
+func (m *Manager) Delete(ID string) error {
+	record, err := m.lookup(ID)
+	if err != nil {
+		return err
+	}
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	if err := m.runtime.Remove(record.SandboxSpec); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(record.Dir); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.sandboxes, ID)
+	m.mu.Unlock()
+	log.Printf("Deleted sandbox '%s'", ID)
+	return nil
+}
+
+func (m *Manager) Logs(ID string) (string, error) {
+	record, err := m.lookup(ID)
+	if err != nil {
+		return "", err
+	}
+	return m.runtime.Logs(record.SandboxSpec)
+}
+
+func (m *Manager) Exec(ID string, command string) (ExecResult, error) {
+	if command == "" {
+		return ExecResult{}, validationError("Command is required")
+	}
+	record, err := m.lookup(ID)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return m.runtime.Exec(record.SandboxSpec, command, execTimeout)
+}
+
+// Port returns the local port the sandbox's workload listens on.
+func (m *Manager) Port(ID string) (int, error) {
+	record, err := m.lookup(ID)
+	if err != nil {
+		return 0, err
+	}
+	return record.Port, nil
+}
+
+// ListVolumes lists the volumes kept in the data directory.
+func (m *Manager) ListVolumes() ([]Volume, error) {
+	entries, err := os.ReadDir(filepath.Join(m.dataDir, "volumes"))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Volume{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	volumes := []Volume{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			volumes = append(volumes, Volume{Name: entry.Name(), Sandboxes: m.volumeUsers(entry.Name())})
+		}
+	}
+	return volumes, nil
+}
+
+// DeleteVolume deletes a volume kept in the data directory, with its data.
+// It refuses while a sandbox still mounts it.
+func (m *Manager) DeleteVolume(name string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return validationError("Invalid volume name '%s'", name)
+	}
+	dir := filepath.Join(m.dataDir, "volumes", name)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return notFoundError("Volume not found with name '%s'", name)
+	}
+	if users := m.volumeUsers(name); len(users) > 0 {
+		return conflictError("Volume '%s' is still mounted by sandboxes %s", name, strings.Join(users, ", "))
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	log.Printf("Deleted volume '%s'", name)
+	return nil
+}
+
+// mounts resolves the requested mounts to directories on this machine,
+// creating the directories of volumes the agent keeps itself.
+func (m *Manager) mounts(requests []MountRequest) ([]Mount, error) {
+	mounts := make([]Mount, 0, len(requests))
+	for _, request := range requests {
+		if !volumeNamePattern.MatchString(request.Volume) {
+			return nil, validationError("Invalid volume name '%s'", request.Volume)
+		}
+		if !filepath.IsAbs(request.Path) || filepath.Clean(request.Path) != request.Path || request.Path == "/" {
+			return nil, validationError("Mount path '%s' must be a clean absolute path below '/'", request.Path)
+		}
+		source := request.HostPath
+		if source == "" {
+			dir, err := filepath.Abs(filepath.Join(m.dataDir, "volumes", request.Volume))
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, err
+			}
+			source = dir
+		} else if info, err := os.Stat(source); err != nil || !info.IsDir() {
+			return nil, validationError("Volume '%s' is not mounted at '%s'", request.Volume, source)
+		}
+		mounts = append(mounts, Mount{Volume: request.Volume, Source: source, Path: request.Path})
+	}
+	return mounts, nil
+}
+
+// volumeUsers lists the sandboxes mounting the volume.
+func (m *Manager) volumeUsers(name string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []string{}
+	for id, record := range m.sandboxes {
+		for _, mount := range record.Mounts {
+			if mount.Volume == name {
+				users = append(users, id)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (m *Manager) change(ID string, apply func(record *sandboxRecord) error) (Sandbox, error) {
+	record, err := m.lookup(ID)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	if err := apply(record); err != nil {
+		return Sandbox{}, err
+	}
+	return m.sandbox(record)
+}
+
+func (m *Manager) lookup(ID string) (*sandboxRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.sandboxes[ID]
+	if !ok {
+		return nil, notFoundError("Sandbox not found with ID '%s'", ID)
+	}
+	return record, nil
+}
+
+// sandbox describes a record for the API. Callers hold record.mu.
+func (m *Manager) sandbox(record *sandboxRecord) (Sandbox, error) {
+	sandbox := Sandbox{
+		ID:           record.ID,
+		PreviewURL:   fmt.Sprintf("http://%s/sandboxes/%s/", record.Host, record.ID),
+		WebsocketURL: fmt.Sprintf("ws://%s/sandboxes/%s/ws", record.Host, record.ID),
+	}
+	state, err := m.runtime.State(record.SandboxSpec)
+	if err != nil {
+		return sandbox, err
+	}
+	switch {
+	case state.Running:
+		sandbox.Status = "running"
+	case record.Stopped:
+		sandbox.Status = "stopped"
+	default:
+		sandbox.Status = "exited"
+		exitCode := state.ExitCode
+		sandbox.ExitCode = &exitCode
+	}
+	return sandbox, nil
+}
+
+// freePort finds a port in the sandbox range that no sandbox has and nothing
+// else is listening on. Callers hold m.mu.
+func (m *Manager) freePort() (int, error) {
+	used := make(map[int]bool, len(m.sandboxes))
+	for _, record := range m.sandboxes {
+		used[record.Port] = true
+	}
+	for port := m.firstPort; port <= m.lastPort; port++ {
+		if used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+	return 0, errors.New("No free port left for a new sandbox")
+}
+
+func (r *sandboxRecord) save() error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(r.Dir, "sandbox.json.tmp")
+	if err := os.WriteFile(tmp, contents, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.Dir, "sandbox.json"))
+}
+
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
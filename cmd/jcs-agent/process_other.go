@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup can only kill the shell itself without process groups.
+func killProcessGroup(pid int, force bool) {
+	if process, err := os.FindProcess(pid); err == nil {
+		process.Kill()
+	}
+}
+
+// processStartTime can't tell processes apart here, so leftover sandboxes
+// are never killed.
+func processStartTime(pid int) (string, error) {
+	return "", errors.New("Process start times are not supported on this system")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLogBytes is how much of the end of a sandbox's log is returned.
+const maxLogBytes = 1 << 20
+
+// ProcessRuntime runs each sandbox as a plain shell command on this machine,
+// in its own process group and working directory. There is no image: the
+// start command is run as is, or the image name if there is no start command.
+// Volumes are linked into the working directory at their mount paths.
+// It doesn't enforce resource limits, so it is meant for development and
+// trusted workloads.
+type ProcessRuntime struct {
+	mu        sync.Mutex
+	processes map[string]*process
+}
+
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	// exitCode is set once done is closed.
+	exitCode int
+}
+
+func NewProcessRuntime() *ProcessRuntime {
+	return &ProcessRuntime{processes: make(map[string]*process)}
+}
+
+func (p *ProcessRuntime) Start(spec SandboxSpec) error {
+	if err := p.Stop(spec, 0); err != nil {
+		return err
+	}
+
+	command := spec.StartCommand
+	if command == "" {
+		command = spec.ImageName
+	}
+	workDir := filepath.Join(spec.Dir, "root")
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return err
+	}
+	if err := linkMounts(workDir, spec.Mounts); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(spec.Dir, "log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = workDir
+	cmd.Env = sandboxEnv(spec)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("Error starting '%s': %v", command, err)
+	}
+	// Remember the process group, so it can be cleaned up even after the
+	// agent restarts, and when its leader started, so a pid the system has
+	// since given to another process is left alone
+	started, _ := processStartTime(cmd.Process.Pid)
+	os.WriteFile(filepath.Join(spec.Dir, "pid"), []byte(fmt.Sprintf("%d %s", cmd.Process.Pid, started)), 0o644)
+
+	proc := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		logFile.Close()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			proc.exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			proc.exitCode = -1
+		}
+		close(proc.done)
+	}()
+
+	p.mu.Lock()
+	p.processes[spec.ID] = proc
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *ProcessRuntime) Stop(spec SandboxSpec, grace time.Duration) error {
+	p.mu.Lock()
+	proc, ok := p.processes[spec.ID]
+	p.mu.Unlock()
+
+	if !ok {
+		// Left over from before the agent restarted, if anything. A group
+		// whose leader is gone keeps its pid from being reused, so only a
+		// live leader needs to be the one that was started
+		if pid, started, err := readPid(spec.Dir); err == nil {
+			if current, err := processStartTime(pid); err == nil && (current == "" || current == started) {
+				killProcessGroup(pid, true)
+			}
+			os.Remove(filepath.Join(spec.Dir, "pid"))
+		}
+		return nil
+	}
+
+	select {
+	case <-proc.done:
+		return nil
+	default:
+	}
+	killProcessGroup(proc.cmd.Process.Pid, false)
+	select {
+	case <-proc.done:
+	case <-time.After(grace):
+		killProcessGroup(proc.cmd.Process.Pid, true)
+		<-proc.done
+	}
+	return nil
+}
+
+func (p *ProcessRuntime) Remove(spec SandboxSpec) error {
+	if err := p.Stop(spec, 0); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.processes, spec.ID)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *ProcessRuntime) State(spec SandboxSpec) (RuntimeState, error) {
+	p.mu.Lock()
+	proc, ok := p.processes[spec.ID]
+	p.mu.Unlock()
+	if !ok {
+		return RuntimeState{ExitCode: -1}, nil
+	}
+	select {
+	case <-proc.done:
+		return RuntimeState{ExitCode: proc.exitCode}, nil
+	default:
+		return RuntimeState{Running: true}, nil
+	}
+}
+
+func (p *ProcessRuntime) Logs(spec SandboxSpec) (string, error) {
+	file, err := os.Open(filepath.Join(spec.Dir, "log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil && info.Size() > maxLogBytes {
+		file.Seek(-maxLogBytes, io.SeekEnd)
+	}
+	logs, err := io.ReadAll(file)
+	return string(logs), err
+}
+
+func (p *ProcessRuntime) Exec(spec SandboxSpec, command string, timeout time.Duration) (ExecResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Dir = filepath.Join(spec.Dir, "root")
+	cmd.Env = sandboxEnv(spec)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return ExecResult{ExitCode: exitErr.ExitCode(), Output: output.String()}, nil
+	case err != nil:
+		return ExecResult{}, err
+	}
+	return ExecResult{Output: output.String()}, nil
+}
+
+// sandboxEnv is the sandbox's own environment plus $PORT, a $PATH and a
+// $HOME in its working directory. Nothing of the agent's is passed on; its
+// environment holds the token the control plane authenticates with.
+func sandboxEnv(spec SandboxSpec) []string {
+	env := []string{
+		"PATH=" + envOr("PATH", "/usr/local/bin:/usr/bin:/bin"),
+		"HOME=" + filepath.Join(spec.Dir, "root"),
+	}
+	for name, value := range spec.Env {
+		env = append(env, name+"="+value)
+	}
+	return append(env, fmt.Sprintf("PORT=%d", spec.Port))
+}
+
+// readPid returns the pid recorded in dir and when that process started.
+func readPid(dir string) (int, string, error) {
+	contents, err := os.ReadFile(filepath.Join(dir, "pid"))
+	if err != nil {
+		return 0, "", err
+	}
+	pid, started, _ := strings.Cut(string(bytes.TrimSpace(contents)), " ")
+	number, err := strconv.Atoi(pid)
+	return number, started, err
+}
+
+// linkMounts makes each mount's volume appear at its path below workDir, the
+// closest a plain process gets to a mount.
+func linkMounts(workDir string, mounts []Mount) error {
+	for _, mount := range mounts {
+		link := filepath.Join(workDir, mount.Path)
+		if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Error mounting volume '%s' at '%s': %v", mount.Volume, mount.Path, err)
+		}
+		if err := os.Symlink(mount.Source, link); err != nil {
+			return fmt.Errorf("Error mounting volume '%s' at '%s': %v", mount.Volume, mount.Path, err)
+		}
+	}
+	return nil
+}
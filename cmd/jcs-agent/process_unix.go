@@ -0,0 +1,51 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup puts the command in its own process group, so stopping a
+// sandbox also stops everything its shell started.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(pid int, force bool) {
+	signal := syscall.SIGTERM
+	if force {
+		signal = syscall.SIGKILL
+	}
+	syscall.Kill(-pid, signal)
+}
+
+// processStartTime tells the process with pid apart from any other that is
+// given the same pid later. It returns "" if there is no such process.
+func processStartTime(pid int) (string, error) {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return "", nil
+	}
+	if stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		// The start time is the 22nd field; the command name before it may
+		// contain spaces, but is followed by the last ')'
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 20 {
+			return "", fmt.Errorf("Unexpected contents of /proc/%d/stat", pid)
+		}
+		return fields[19], nil
+	}
+	// No /proc on this system
+	output, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type agentHeartbeat struct {
+	Version    string    `json:"version"`
+	Capacity   Resources `json:"capacity"`
+	SandboxIDs []string  `json:"sandbox_ids"`
+}
+
+type agentRegistration struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	agentHeartbeat
+}
+
+type registrationResponse struct {
+	ServerID                 string `json:"server_id"`
+	HeartbeatIntervalSeconds int    `json:"heartbeat_interval_seconds"`
+	AgentToken               string `json:"agent_token"`
+}
+
+// errNotRegistered means the control plane no longer knows this agent's
+// server, so the agent registers again.
+var errNotRegistered = fmt.Errorf("Agent is not registered with the control plane")
+
+// Registrar registers the agent with the control plane and keeps it posted
+// with heartbeats, so the control plane can tell when this server dies. It
+// registers with bootstrapToken until the control plane has issued apiToken,
+// and with apiToken from then on.
+type Registrar struct {
+	controlPlaneURL string
+	bootstrapToken  string
+	apiToken        *apiToken
+	name            string
+	address         string
+	manager         *Manager
+	client          *http.Client
+}
+
+const defaultHeartbeatInterval = 10 * time.Second
+
+func (r *Registrar) Run(ctx context.Context) {
+	serverID := ""
+	interval := defaultHeartbeatInterval
+	for {
+		if serverID == "" {
+			response, err := r.register()
+			if err != nil {
+				log.Printf("Error registering with the control plane: %v", err)
+			} else {
+				serverID = response.ServerID
+				if response.AgentToken != "" {
+					if err := r.apiToken.Set(response.AgentToken); err != nil {
+						log.Printf("Error saving the agent token: %v", err)
+					}
+				}
+				if response.HeartbeatIntervalSeconds > 0 {
+					interval = time.Duration(response.HeartbeatIntervalSeconds) * time.Second
+				}
+				log.Printf("Registered with the control plane as server '%s'", serverID)
+			}
+		} else if err := r.heartbeat(serverID); err == errNotRegistered {
+			log.Printf("Control plane forgot server '%s', registering again", serverID)
+			serverID = ""
+			continue
+		} else if err != nil {
+			log.Printf("Error sending heartbeat: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *Registrar) register() (registrationResponse, error) {
+	var response registrationResponse
+	request := agentRegistration{Name: r.name, Address: r.address, agentHeartbeat: r.status()}
+	err := r.post("/api/agents/register", request, &response)
+	return response, err
+}
+
+func (r *Registrar) heartbeat(serverID string) error {
+	return r.post(fmt.Sprintf("/api/agents/%s/heartbeat", serverID), r.status(), nil)
+}
+
+func (r *Registrar) status() agentHeartbeat {
+	return agentHeartbeat{
+		Version:    version,
+		Capacity:   Resources{CPU: float64(runtime.NumCPU()), MemoryMB: memoryMB(), DiskMB: diskMB(r.manager.dataDir)},
+		SandboxIDs: r.manager.IDs(),
+	}
+}
+
+func (r *Registrar) post(path string, body any, result any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(r.controlPlaneURL, "/")+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token := r.apiToken.Get()
+	if token == "" {
+		token = r.bootstrapToken
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotRegistered
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Control plane returned %d: %s", resp.StatusCode, bytes.TrimSpace(responseBody))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, result)
+}
+
+// memoryMB reads the machine's total memory from /proc/meminfo, or returns
+// zero where there is none.
+func memoryMB() int {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.Atoi(fields[1])
+			return kb / 1024
+		}
+	}
+	return 0
+}
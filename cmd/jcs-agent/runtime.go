@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resources are a sandbox's limits, or this machine's capacity when reported
+// to the control plane. Zero means unlimited.
+type Resources struct {
+	CPU      float64 `json:"cpu,omitempty"`
+	MemoryMB int     `json:"memory_mb,omitempty"`
+	DiskMB   int     `json:"disk_mb,omitempty"`
+	Pids     int     `json:"pids,omitempty"`
+}
+
+// SandboxSpec is everything a runtime needs to start a sandbox's workload.
+type SandboxSpec struct {
+	ID           string    `json:"id"`
+	ImageName    string    `json:"image_name"`
+	StartCommand string    `json:"start_command,omitempty"`
+	Resources    Resources `json:"resources,omitempty"`
+	// Env may hold secrets, so it is never logged or returned by the API.
+	Env map[string]string `json:"env,omitempty"`
+	// Mounts are the volumes to make available inside the sandbox.
+	Mounts []Mount `json:"mounts,omitempty"`
+	// Port is the local port the workload should listen on; it is passed in
+	// as $PORT and the agent proxies preview traffic to it.
+	Port int `json:"port"`
+	// Dir is a directory the runtime may keep the sandbox's files in.
+	Dir string `json:"-"`
+}
+
+// Mount makes the host directory Source available at Path in the sandbox.
+type Mount struct {
+	Volume string `json:"volume"`
+	Source string `json:"source"`
+	Path   string `json:"path"`
+}
+
+// RuntimeState is what a runtime knows about a sandbox's workload.
+type RuntimeState struct {
+	Running  bool
+	ExitCode int
+}
+
+type ExecResult struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// Runtime runs sandbox workloads. The Manager keeps track of sandboxes and
+// their statuses; a runtime only starts, stops and inspects workloads, so
+// supporting another container engine means implementing this interface and
+// adding it to runtimes. A runtime enforces as much of spec.Resources as its
+// engine can.
+type Runtime interface {
+	// Start launches the workload, replacing any previous one for spec.ID.
+	Start(spec SandboxSpec) error
+	// Stop ends the workload, waiting up to grace before killing it. Stopping
+	// a workload that isn't running is not an error.
+	Stop(spec SandboxSpec, grace time.Duration) error
+	// Remove stops the workload and releases everything it holds.
+	Remove(spec SandboxSpec) error
+	State(spec SandboxSpec) (RuntimeState, error)
+	Logs(spec SandboxSpec) (string, error)
+	Exec(spec SandboxSpec, command string, timeout time.Duration) (ExecResult, error)
+}
+
+var runtimes = map[string]func() (Runtime, error){
+	"process": func() (Runtime, error) { return NewProcessRuntime(), nil },
+	"docker":  NewDockerRuntime,
+}
+
+func NewRuntime(name string) (Runtime, error) {
+	newRuntime, ok := runtimes[name]
+	if !ok {
+		names := make([]string, 0, len(runtimes))
+		for name := range runtimes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown runtime '%s', expected one of: %s", name, strings.Join(names, ", "))
+	}
+	return newRuntime()
+}
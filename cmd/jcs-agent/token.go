@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// agentToken is the token the control plane presents to an agent it reaches
+// at host, derived from the shared token the same way the control plane does.
+func agentToken(secret string, host string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiToken is the token the control plane issued this agent when it
+// registered. It is kept in the data directory so the agent still has it
+// after a restart, when the single-use bootstrap token is spent.
+type apiToken struct {
+	mu    sync.Mutex
+	path  string
+	value string
+}
+
+// loadAPIToken reads the token saved at path, if there is one.
+func loadAPIToken(path string) (*apiToken, error) {
+	token := &apiToken{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	token.value = strings.TrimSpace(string(data))
+	return token, nil
+}
+
+func (t *apiToken) Get() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.value
+}
+
+// Set saves value, readable by the agent's user alone.
+func (t *apiToken) Set(value string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if value == t.value {
+		return nil
+	}
+	if err := os.WriteFile(t.path, []byte(value+"\n"), 0o600); err != nil {
+		return err
+	}
+	t.value = value
+	return nil
+}
+
+func tokensEqual(a string, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
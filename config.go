@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+var defaultConfigPath = "jcs.yaml"
+
+type Config struct {
+	Port       string           `yaml:"port"`
+	Provider   string           `yaml:"provider"`
+	Store      StoreConfig      `yaml:"store"`
+	Local      LocalConfig      `yaml:"local"`
+	Hetzner    HetznerConfig    `yaml:"hetzner"`
+	Scheduler  SchedulerConfig  `yaml:"scheduler"`
+	Agent      AgentConfig      `yaml:"agent"`
+	Reconciler ReconcilerConfig `yaml:"reconciler"`
+	Reaper     ReaperConfig     `yaml:"reaper"`
+	WarmPool   WarmPoolConfig   `yaml:"warm_pool"`
+	Bootstrap  BootstrapConfig  `yaml:"bootstrap"`
+	Secrets    SecretsConfig    `yaml:"secrets"`
+}
+
+type StoreConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+type SchedulerConfig struct {
+	// Strategy is one of "binpack", "spread" or "least-loaded".
+	Strategy               string `yaml:"strategy"`
+	MaxContainersPerServer int    `yaml:"max_containers_per_server"`
+	// DefaultResources is assumed for containers that don't request any;
+	// a zero disk_mb or pids leaves them unlimited.
+	DefaultResources Resources `yaml:"default_resources"`
+	// ServerCapacity is used for servers whose provider doesn't report their
+	// size, and to decide whether a container fits on a new server at all. A
+	// zero disk_mb doesn't check disk on those servers.
+	ServerCapacity Resources `yaml:"server_capacity"`
+}
+
+type AgentConfig struct {
+	// Client is "http" to talk to real sandbox agents or "fake" to keep
+	// sandboxes in memory.
+	Client         string `yaml:"client"`
+	TimeoutSeconds int    `yaml:"timeout_seconds"`
+	// ReadyTimeoutSeconds is how long a new server's agent has to pass its
+	// health check before the server is given up on.
+	ReadyTimeoutSeconds int `yaml:"ready_timeout_seconds"`
+	// Agents heartbeat every HeartbeatIntervalSeconds; a server that misses
+	// them for HeartbeatTimeoutSeconds is marked unreachable.
+	HeartbeatIntervalSeconds int `yaml:"heartbeat_interval_seconds"`
+	HeartbeatTimeoutSeconds  int `yaml:"heartbeat_timeout_seconds"`
+	// UnhealthyThreshold is how many health checks in a row, one per
+	// heartbeat interval, an agent may fail before its server is dead.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+}
+
+type ReconcilerConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds"`
+}
+
+type ReaperConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	IntervalSeconds    int  `yaml:"interval_seconds"`
+	GracePeriodSeconds int  `yaml:"grace_period_seconds"`
+	MinServers         int  `yaml:"min_servers"`
+	// DryRun only logs what would be deprovisioned.
+	DryRun bool `yaml:"dry_run"`
+}
+
+type WarmPoolConfig struct {
+	// Size is how many empty servers to keep ready; 0 disables the pool.
+	Size            int `yaml:"size"`
+	IntervalSeconds int `yaml:"interval_seconds"`
+}
+
+type SecretsConfig struct {
+	// KeyPath is the file holding the master key secrets are encrypted with;
+	// one is generated there on first start.
+	KeyPath string `yaml:"key_path"`
+}
+
+// BootstrapConfig controls the cloud-init user_data new servers boot with.
+type BootstrapConfig struct {
+	// ControlPlaneURL is where new servers phone home and their agents
+	// register; empty skips it.
+	ControlPlaneURL string `yaml:"control_plane_url"`
+	// Token never leaves jcs. New servers get a single-use token of their
+	// own instead, and each agent's API token is derived from this one.
+	// Agents started by hand register with it.
+	Token string `yaml:"token"`
+	// AgentURL is where new servers download the jcs-agent binary from.
+	AgentURL          string   `yaml:"agent_url"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+	// Templates maps a server type to a cloud-init template file; "default"
+	// applies to the rest, and without it the built-in template is used.
+	Templates map[string]string `yaml:"templates"`
+}
+
+// LocalConfig controls the local provider, which runs each server as a
+// jcs-agent process on this machine.
+type LocalConfig struct {
+	// AgentBinary is the jcs-agent to spawn; empty keeps a single
+	// "localhost" server whose agent is started by hand.
+	AgentBinary string `yaml:"agent_binary"`
+	// DataDir holds each agent's sandboxes and log.
+	DataDir string `yaml:"data_dir"`
+	// Runtime is the agents' sandbox runtime, "process" or "docker".
+	Runtime string `yaml:"runtime"`
+	// Agents listen on FirstPort onwards, at most MaxServers of them.
+	FirstPort  int `yaml:"first_port"`
+	MaxServers int `yaml:"max_servers"`
+	// Each agent's sandboxes get SandboxPortsPerServer ports of their own,
+	// starting at FirstSandboxPort.
+	FirstSandboxPort      int `yaml:"first_sandbox_port"`
+	SandboxPortsPerServer int `yaml:"sandbox_ports_per_server"`
+}
+
+type HetznerConfig struct {
+	// BaseURL is the Hetzner Cloud API endpoint; point it at a fake to run
+	// without an account.
+	BaseURL    string `yaml:"base_url"`
+	APIKey     string `yaml:"api_key"`
+	ServerType string `yaml:"server_type"`
+	Image      string `yaml:"image"`
+	Location   string `yaml:"location"`
+	// New servers are polled every PollIntervalSeconds until they are
+	// running, for at most ReadyTimeoutSeconds.
+	PollIntervalSeconds int `yaml:"poll_interval_seconds"`
+	ReadyTimeoutSeconds int `yaml:"ready_timeout_seconds"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:     "8002",
+		Provider: "local",
+		Store: StoreConfig{
+			Type: "file",
+			Path: "jcs.json",
+		},
+		Local: LocalConfig{
+			DataDir:               ".jcs-local",
+			Runtime:               "process",
+			FirstPort:             8100,
+			MaxServers:            50,
+			FirstSandboxPort:      20000,
+			SandboxPortsPerServer: 100,
+		},
+		Hetzner: HetznerConfig{
+			BaseURL:             "https://api.hetzner.cloud/v1",
+			ServerType:          "cpx21",
+			Image:               "ubuntu-24.04",
+			PollIntervalSeconds: 2,
+			ReadyTimeoutSeconds: 300,
+		},
+		Scheduler: SchedulerConfig{
+			Strategy:               "binpack",
+			MaxContainersPerServer: 20,
+			DefaultResources:       Resources{CPU: 0.25, MemoryMB: 256},
+			ServerCapacity:         Resources{CPU: 3, MemoryMB: 4096},
+		},
+		Agent: AgentConfig{
+			Client:                   "http",
+			TimeoutSeconds:           30,
+			ReadyTimeoutSeconds:      300,
+			HeartbeatIntervalSeconds: 10,
+			HeartbeatTimeoutSeconds:  30,
+			UnhealthyThreshold:       3,
+		},
+		Reconciler: ReconcilerConfig{
+			IntervalSeconds: 15,
+		},
+		Reaper: ReaperConfig{
+			Enabled:            true,
+			IntervalSeconds:    60,
+			GracePeriodSeconds: 600,
+			MinServers:         1,
+			DryRun:             true,
+		},
+		WarmPool: WarmPoolConfig{
+			IntervalSeconds: 30,
+		},
+		Secrets: SecretsConfig{
+			KeyPath: "jcs.key",
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, then the YAML file at
+// path (if it exists), then environment variables, which may also come from a
+// .env file. An empty path means JCS_CONFIG or jcs.yaml.
+func LoadConfig(path string) (Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+
+	config := defaultConfig()
+
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("JCS_CONFIG")
+		explicit = path != ""
+	}
+	if path == "" {
+		path = defaultConfigPath
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return config, fmt.Errorf("Error reading config file '%s': %v", path, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(contents, &config); err != nil {
+			return config, fmt.Errorf("Error parsing config file '%s': %v", path, err)
+		}
+	}
+
+	config.applyEnv()
+
+	if err := config.Validate(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func (c *Config) applyEnv() {
+	overrides := map[string]*string{
+		"JCS_PORT":            &c.Port,
+		"JCS_PROVIDER":        &c.Provider,
+		"JCS_LOCAL_AGENT":     &c.Local.AgentBinary,
+		"JCS_STORE":           &c.Store.Type,
+		"JCS_STORE_PATH":      &c.Store.Path,
+		"HETZNER_BASE_URL":    &c.Hetzner.BaseURL,
+		"HETZNER_API_KEY":     &c.Hetzner.APIKey,
+		"HETZNER_SERVER_TYPE": &c.Hetzner.ServerType,
+		"HETZNER_IMAGE":       &c.Hetzner.Image,
+		"HETZNER_LOCATION":    &c.Hetzner.Location,
+		"JCS_SCHEDULER":       &c.Scheduler.Strategy,
+		"JCS_AGENT_CLIENT":    &c.Agent.Client,
+		"JCS_URL":             &c.Bootstrap.ControlPlaneURL,
+		"JCS_BOOTSTRAP_TOKEN": &c.Bootstrap.Token,
+		"JCS_AGENT_URL":       &c.Bootstrap.AgentURL,
+		"JCS_SECRETS_KEY":     &c.Secrets.KeyPath,
+	}
+	for name, field := range overrides {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value
+		}
+	}
+}
+
+// Validate reports every problem with the configuration at once so they can
+// all be fixed before the next start.
+func (c *Config) Validate() error {
+	problems := []string{}
+
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be a number between 1 and 65535, got '%s'", c.Port))
+	}
+
+	switch c.Store.Type {
+	case "memory":
+	case "file":
+		if c.Store.Path == "" {
+			problems = append(problems, "store.path is required when store.type is 'file'")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("store.type must be 'file' or 'memory', got '%s'", c.Store.Type))
+	}
+
+	switch c.Provider {
+	case "local":
+		if c.Local.AgentBinary != "" {
+			problems = append(problems, c.Local.validate()...)
+		}
+	case "hetzner":
+		if c.Hetzner.BaseURL == "" {
+			problems = append(problems, "hetzner.base_url is required when provider is 'hetzner'")
+		}
+		if c.Hetzner.APIKey == "" {
+			problems = append(problems, "hetzner.api_key (or HETZNER_API_KEY) is required when provider is 'hetzner'")
+		}
+		if c.Hetzner.ServerType == "" {
+			problems = append(problems, "hetzner.server_type is required when provider is 'hetzner'")
+		}
+		if c.Hetzner.Image == "" {
+			problems = append(problems, "hetzner.image is required when provider is 'hetzner'")
+		}
+		if c.Hetzner.PollIntervalSeconds <= 0 {
+			problems = append(problems, "hetzner.poll_interval_seconds must be positive")
+		}
+		if c.Hetzner.ReadyTimeoutSeconds <= 0 {
+			problems = append(problems, "hetzner.ready_timeout_seconds must be positive")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("provider must be 'local' or 'hetzner', got '%s'", c.Provider))
+	}
+
+	if _, ok := schedulingStrategies[c.Scheduler.Strategy]; !ok {
+		problems = append(problems, fmt.Sprintf("scheduler.strategy must be 'binpack', 'spread' or 'least-loaded', got '%s'", c.Scheduler.Strategy))
+	}
+	if c.Scheduler.MaxContainersPerServer < 0 {
+		problems = append(problems, "scheduler.max_containers_per_server must not be negative")
+	}
+	if c.Scheduler.DefaultResources.CPU <= 0 || c.Scheduler.DefaultResources.MemoryMB <= 0 {
+		problems = append(problems, "scheduler.default_resources needs a positive cpu and memory_mb")
+	}
+	if c.Scheduler.ServerCapacity.CPU <= 0 || c.Scheduler.ServerCapacity.MemoryMB <= 0 {
+		problems = append(problems, "scheduler.server_capacity needs a positive cpu and memory_mb")
+	}
+	if c.Scheduler.DefaultResources.Validate() != nil || c.Scheduler.ServerCapacity.Validate() != nil {
+		problems = append(problems, "scheduler.default_resources and scheduler.server_capacity must not be negative")
+	}
+
+	if c.Agent.Client != "http" && c.Agent.Client != "fake" {
+		problems = append(problems, fmt.Sprintf("agent.client must be 'http' or 'fake', got '%s'", c.Agent.Client))
+	}
+	if c.Agent.TimeoutSeconds <= 0 {
+		problems = append(problems, "agent.timeout_seconds must be positive")
+	}
+	if c.Agent.ReadyTimeoutSeconds <= 0 {
+		problems = append(problems, "agent.ready_timeout_seconds must be positive")
+	}
+	if c.Agent.HeartbeatIntervalSeconds <= 0 {
+		problems = append(problems, "agent.heartbeat_interval_seconds must be positive")
+	}
+	if c.Agent.HeartbeatTimeoutSeconds <= c.Agent.HeartbeatIntervalSeconds {
+		problems = append(problems, "agent.heartbeat_timeout_seconds must be longer than agent.heartbeat_interval_seconds")
+	}
+	if c.Agent.UnhealthyThreshold <= 0 {
+		problems = append(problems, "agent.unhealthy_threshold must be positive")
+	}
+
+	if c.Reconciler.IntervalSeconds <= 0 {
+		problems = append(problems, "reconciler.interval_seconds must be positive")
+	}
+
+	if c.Reaper.IntervalSeconds <= 0 {
+		problems = append(problems, "reaper.interval_seconds must be positive")
+	}
+	if c.Reaper.GracePeriodSeconds < 0 {
+		problems = append(problems, "reaper.grace_period_seconds must not be negative")
+	}
+	if c.Reaper.MinServers < 0 {
+		problems = append(problems, "reaper.min_servers must not be negative")
+	}
+
+	if c.WarmPool.Size < 0 {
+		problems = append(problems, "warm_pool.size must not be negative")
+	}
+	if c.WarmPool.IntervalSeconds <= 0 {
+		problems = append(problems, "warm_pool.interval_seconds must be positive")
+	}
+
+	if c.Bootstrap.Token == "" && (c.Bootstrap.ControlPlaneURL != "" || c.Agent.Client == "http") {
+		problems = append(problems, "bootstrap.token (or JCS_BOOTSTRAP_TOKEN) is required when bootstrap.control_plane_url is set or agent.client is 'http'")
+	}
+	if c.Provider == "hetzner" && c.Bootstrap.AgentURL == "" {
+		problems = append(problems, "bootstrap.agent_url (or JCS_AGENT_URL) is required when provider is 'hetzner'")
+	}
+	if c.Provider == "hetzner" && c.Bootstrap.ControlPlaneURL == "" {
+		problems = append(problems, "bootstrap.control_plane_url (or JCS_URL) is required when provider is 'hetzner', so new servers' agents can register and get their token")
+	}
+	for serverType, path := range c.Bootstrap.Templates {
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("bootstrap.templates.%s: %v", serverType, err))
+		}
+	}
+
+	if c.Secrets.KeyPath == "" {
+		problems = append(problems, "secrets.key_path is required")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+func (l LocalConfig) validate() []string {
+	problems := []string{}
+	if _, err := exec.LookPath(l.AgentBinary); err != nil {
+		problems = append(problems, fmt.Sprintf("local.agent_binary: %v", err))
+	}
+	if l.DataDir == "" {
+		problems = append(problems, "local.data_dir is required when local.agent_binary is set")
+	}
+	if l.Runtime != "process" && l.Runtime != "docker" {
+		problems = append(problems, fmt.Sprintf("local.runtime must be 'process' or 'docker', got '%s'", l.Runtime))
+	}
+	if l.MaxServers <= 0 || l.SandboxPortsPerServer <= 0 {
+		problems = append(problems, "local.max_servers and local.sandbox_ports_per_server must be positive")
+		return problems
+	}
+	lastPort := l.FirstPort + l.MaxServers - 1
+	lastSandboxPort := l.FirstSandboxPort + l.MaxServers*l.SandboxPortsPerServer - 1
+	if l.FirstPort < 1 || lastPort > 65535 || l.FirstSandboxPort < 1 || lastSandboxPort > 65535 {
+		problems = append(problems, fmt.Sprintf("local agent ports %d-%d and sandbox ports %d-%d must be between 1 and 65535", l.FirstPort, lastPort, l.FirstSandboxPort, lastSandboxPort))
+	} else if l.FirstPort <= lastSandboxPort && l.FirstSandboxPort <= lastPort {
+		problems = append(problems, fmt.Sprintf("local agent ports %d-%d overlap sandbox ports %d-%d", l.FirstPort, lastPort, l.FirstSandboxPort, lastSandboxPort))
+	}
+	return problems
+}
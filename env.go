@@ -0,0 +1,111 @@
+package main
+
+import (
+	"maps"
+	"regexp"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnv are set by the sandbox agent itself.
+var reservedEnv = map[string]bool{"PORT": true}
+
+// reservedEnvPrefix is kept for the docker CLI's own configuration, which no
+// sandbox's environment should be able to reach.
+const reservedEnvPrefix = "DOCKER_"
+
+// validateEnv checks a template's environment: valid names, nothing reserved,
+// no variable set both directly and from a secret, and only secrets that
+// exist.
+func validateEnv(env map[string]string, secrets map[string]string) error {
+	for name := range env {
+		if err := validateEnvName(name); err != nil {
+			return err
+		}
+		if _, ok := secrets[name]; ok {
+			return ValidationError("Environment variable '%s' is set both directly and from a secret", name)
+		}
+	}
+	for name, secret := range secrets {
+		if err := validateEnvName(name); err != nil {
+			return err
+		}
+		if !secretHandler.Exists(secret) {
+			return ValidationError("Secret '%s' referenced by %s does not exist", secret, name)
+		}
+	}
+	return nil
+}
+
+func validateEnvName(name string) error {
+	if !envNamePattern.MatchString(name) {
+		return ValidationError("Invalid environment variable name '%s'", name)
+	}
+	if reservedEnv[name] {
+		return ValidationError("Environment variable '%s' is set by the sandbox agent", name)
+	}
+	if strings.HasPrefix(name, reservedEnvPrefix) {
+		return ValidationError("Environment variable '%s' is reserved: names starting with %s configure the docker runtime", name, reservedEnvPrefix)
+	}
+	return nil
+}
+
+// withOverrides layers a container's own environment and mounts over its
+// service's: a variable set in either of override's maps replaces the
+// service's, whether it was set directly or from a secret.
+func (t ServiceTemplate) withOverrides(override ServiceTemplate) ServiceTemplate {
+	env := maps.Clone(t.Env)
+	secrets := maps.Clone(t.Secrets)
+	for name, value := range override.Env {
+		delete(secrets, name)
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[name] = value
+	}
+	for name, secret := range override.Secrets {
+		delete(env, name)
+		if secrets == nil {
+			secrets = make(map[string]string)
+		}
+		secrets[name] = secret
+	}
+	override.Env = env
+	override.Secrets = secrets
+	override.Mounts = mergeMounts(t.Mounts, override.Mounts)
+	return override
+}
+
+// mergeMounts adds the overriding mounts to base, replacing a base mount at
+// the same path or of the same volume.
+func mergeMounts(base []VolumeMount, overrides []VolumeMount) []VolumeMount {
+	merged := []VolumeMount{}
+	for _, mount := range base {
+		replaced := false
+		for _, override := range overrides {
+			if override.Path == mount.Path || override.Volume == mount.Volume {
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, mount)
+		}
+	}
+	merged = append(merged, overrides...)
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// environment resolves the template's secrets and returns every variable the
+// sandbox is started with.
+func (t ServiceTemplate) environment() (map[string]string, error) {
+	env, err := secretHandler.Resolve(t.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(env, t.Env)
+	return env, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind classifies an error so the API can answer with the right status
+// code. Its value is also the machine-readable "code" in error responses.
+type ErrorKind string
+
+const (
+	ErrInternal            ErrorKind = "internal"
+	ErrNotFound            ErrorKind = "not_found"
+	ErrConflict            ErrorKind = "conflict"
+	ErrValidation          ErrorKind = "validation"
+	ErrUnauthorized        ErrorKind = "unauthorized"
+	ErrProviderUnavailable ErrorKind = "provider_unavailable"
+	ErrAgentUnreachable    ErrorKind = "agent_unreachable"
+)
+
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrConflict:
+		return http.StatusConflict
+	case ErrValidation:
+		return http.StatusBadRequest
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrProviderUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrAgentUnreachable:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind ErrorKind, err error, format string, args ...any) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+func NotFoundError(format string, args ...any) error {
+	return newError(ErrNotFound, nil, format, args...)
+}
+
+func ConflictError(format string, args ...any) error {
+	return newError(ErrConflict, nil, format, args...)
+}
+
+func ValidationError(format string, args ...any) error {
+	return newError(ErrValidation, nil, format, args...)
+}
+
+func UnauthorizedError(format string, args ...any) error {
+	return newError(ErrUnauthorized, nil, format, args...)
+}
+
+func ProviderUnavailableError(err error, format string, args ...any) error {
+	return newError(ErrProviderUnavailable, err, format, args...)
+}
+
+func AgentUnreachableError(err error, format string, args ...any) error {
+	return newError(ErrAgentUnreachable, err, format, args...)
+}
+
+// KindOf returns the kind of the outermost typed error in err's chain, or
+// ErrInternal for errors nobody classified.
+func KindOf(err error) ErrorKind {
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed.Kind
+	}
+	return ErrInternal
+}
+
+// IsNotFound is a shortcut for the check callers make most often.
+func IsNotFound(err error) bool {
+	return KindOf(err) == ErrNotFound
+}
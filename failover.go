@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// containerLost is the status of a container whose server stopped answering;
+// its sandbox may or may not still be running there.
+const containerLost = "lost"
+
+// maxServiceEvents bounds how many events a service keeps, oldest dropped first.
+const maxServiceEvents = 50
+
+type ServiceEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Message     string    `json:"message"`
+	ContainerID string    `json:"container_id,omitempty"`
+	ServerID    string    `json:"server_id,omitempty"`
+}
+
+// recordEvent appends an event to the service. Callers save the service.
+func (s *Service) recordEvent(eventType string, container Container, format string, args ...any) {
+	event := ServiceEvent{
+		Time:        time.Now().UTC(),
+		Type:        eventType,
+		Message:     fmt.Sprintf(format, args...),
+		ContainerID: container.ID,
+		ServerID:    container.ServerID,
+	}
+	s.Events = append(s.Events, event)
+	if len(s.Events) > maxServiceEvents {
+		s.Events = append([]ServiceEvent(nil), s.Events[len(s.Events)-maxServiceEvents:]...)
+	}
+	log.Printf("Service '%s': %s", s.ID, event.Message)
+}
+
+// RescheduleServerContainers marks every container on a server that stopped
+// answering as lost and tries to replace each one on a healthy server.
+func (s *ServiceHandler) RescheduleServerContainers(serverID string) error {
+	containers, err := s.ListServerContainers(serverID)
+	if err != nil {
+		return err
+	}
+	byService := make(map[string][]string)
+	for _, container := range containers {
+		byService[container.ServiceID] = append(byService[container.ServiceID], container.ID)
+	}
+
+	for serviceID, containerIDs := range byService {
+		if err := s.rescheduleLost(serviceID, containerIDs); err != nil && !IsNotFound(err) {
+			log.Printf("Rescheduling containers of service '%s' failed: %v", serviceID, err)
+		}
+	}
+	return nil
+}
+
+func (s *ServiceHandler) rescheduleLost(serviceID string, containerIDs []string) error {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return err
+	}
+	for _, containerID := range containerIDs {
+		container, ok := service.Containers[containerID]
+		if !ok || container.Status == containerLost {
+			continue
+		}
+		container.Status = containerLost
+		service.Containers[containerID] = container
+		service.recordEvent("container_lost", container, "Container '%s' lost: server '%s' is unreachable", container.ID, container.ServerID)
+	}
+	if err := s.SaveService(service); err != nil {
+		return err
+	}
+
+	for _, containerID := range containerIDs {
+		if _, ok := service.Containers[containerID]; !ok {
+			continue
+		}
+		if _, err := service.replaceLostContainer(containerID); err != nil {
+			log.Printf("Rescheduling container '%s' failed: %v", containerID, err)
+		}
+	}
+	return nil
+}
+
+// recoverLostContainers gives the lost containers on a server that answers
+// again the status of their sandboxes. Those whose sandbox is gone stay lost
+// and are replaced.
+func (s *ServiceHandler) recoverLostContainers(serverID string, sandboxes []Sandbox) error {
+	statuses := make(map[string]string, len(sandboxes))
+	for _, sandbox := range sandboxes {
+		statuses[sandbox.ID] = sandbox.Status
+	}
+	containers, err := s.ListServerContainers(serverID)
+	if err != nil {
+		return err
+	}
+	byService := make(map[string][]string)
+	for _, container := range containers {
+		if container.Status == containerLost && statuses[container.SandboxID] != "" {
+			byService[container.ServiceID] = append(byService[container.ServiceID], container.ID)
+		}
+	}
+
+	for serviceID, containerIDs := range byService {
+		if err := s.recoverLost(serviceID, containerIDs, statuses); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ServiceHandler) recoverLost(serviceID string, containerIDs []string, statuses map[string]string) error {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return err
+	}
+	for _, containerID := range containerIDs {
+		// It may have been replaced in the meantime
+		container, ok := service.Containers[containerID]
+		if !ok || container.Status != containerLost {
+			continue
+		}
+		container.Status = statuses[container.SandboxID]
+		service.Containers[containerID] = container
+		service.recordEvent("container_recovered", container, "Container '%s' recovered: server '%s' answers again", container.ID, container.ServerID)
+	}
+	return s.SaveService(service)
+}
+
+// replaceLostContainer starts a copy of a lost container wherever the
+// scheduler places it and forgets the original. Its sandbox can't be deleted
+// while its server is unreachable, so it is recorded on the server and
+// deleted once the server answers again.
+func (s *Service) replaceLostContainer(ID string) (Container, error) {
+	container := s.Containers[ID]
+	replacement, err := s.CreateContainer(container.template())
+	if err != nil {
+		// The reconciler retries every pass; one event per failure streak is enough
+		if last := len(s.Events) - 1; last >= 0 && s.Events[last].Type == "reschedule_failed" && s.Events[last].ContainerID == ID {
+			return Container{}, err
+		}
+		s.recordEvent("reschedule_failed", container, "Could not reschedule lost container '%s': %v", container.ID, err)
+		if saveErr := serviceHandler.SaveService(*s); saveErr != nil {
+			return Container{}, saveErr
+		}
+		return Container{}, err
+	}
+
+	delete(s.Containers, ID)
+	s.recordEvent("container_rescheduled", replacement, "Rescheduled lost container '%s' as '%s' on server '%s'", container.ID, replacement.ID, replacement.ServerID)
+	if err := serviceHandler.SaveService(*s); err != nil {
+		return replacement, err
+	}
+	if err := serverHandler.recordOrphanedSandbox(container.ServerID, container.SandboxID); err != nil {
+		return replacement, err
+	}
+	return replacement, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FakeSandboxClient keeps sandboxes in memory instead of talking to an agent,
+// so the control plane can run without any servers behind it.
+type FakeSandboxClient struct {
+	mu        sync.Mutex
+	sandboxes map[string]map[string]Sandbox
+	logs      map[string][]string
+}
+
+func NewFakeSandboxClient() *FakeSandboxClient {
+	return &FakeSandboxClient{
+		sandboxes: make(map[string]map[string]Sandbox),
+		logs:      make(map[string][]string),
+	}
+}
+
+func (f *FakeSandboxClient) CreateSandbox(host string, request SandboxCreateRequest) (Sandbox, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, err := randomHex(6)
+	if err != nil {
+		return Sandbox{}, err
+	}
+	sandbox := Sandbox{
+		ID:           id,
+		Status:       "running",
+		PreviewURL:   fmt.Sprintf("http://%s/sandboxes/%s", host, id),
+		WebsocketURL: fmt.Sprintf("ws://%s/sandboxes/%s/ws", host, id),
+	}
+	if f.sandboxes[host] == nil {
+		f.sandboxes[host] = make(map[string]Sandbox)
+	}
+	f.sandboxes[host][id] = sandbox
+	f.logs[id] = []string{fmt.Sprintf("started %s %s", request.ImageName, request.StartCommand)}
+
+	return sandbox, nil
+}
+
+func (f *FakeSandboxClient) GetSandbox(host string, ID string) (Sandbox, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sandbox, ok := f.sandboxes[host][ID]
+	if !ok {
+		return sandbox, errSandboxNotFound
+	}
+	return sandbox, nil
+}
+
+func (f *FakeSandboxClient) ListSandboxes(host string) ([]Sandbox, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sandboxes := make([]Sandbox, 0, len(f.sandboxes[host]))
+	for _, sandbox := range f.sandboxes[host] {
+		sandboxes = append(sandboxes, sandbox)
+	}
+	sort.Slice(sandboxes, func(i, j int) bool { return sandboxes[i].ID < sandboxes[j].ID })
+	return sandboxes, nil
+}
+
+func (f *FakeSandboxClient) StopSandbox(host string, ID string) (Sandbox, error) {
+	return f.setStatus(host, ID, "stopped")
+}
+
+func (f *FakeSandboxClient) StartSandbox(host string, ID string) (Sandbox, error) {
+	return f.setStatus(host, ID, "running")
+}
+
+func (f *FakeSandboxClient) RestartSandbox(host string, ID string) (Sandbox, error) {
+	return f.setStatus(host, ID, "running")
+}
+
+func (f *FakeSandboxClient) DeleteSandbox(host string, ID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sandboxes[host][ID]; !ok {
+		return errSandboxNotFound
+	}
+	delete(f.sandboxes[host], ID)
+	delete(f.logs, ID)
+	return nil
+}
+
+func (f *FakeSandboxClient) SandboxLogs(host string, ID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sandboxes[host][ID]; !ok {
+		return "", errSandboxNotFound
+	}
+	logs := ""
+	for _, line := range f.logs[ID] {
+		logs += line + "\n"
+	}
+	return logs, nil
+}
+
+func (f *FakeSandboxClient) ExecSandbox(host string, ID string, request SandboxExecRequest) (SandboxExecResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sandboxes[host][ID]; !ok {
+		return SandboxExecResult{}, errSandboxNotFound
+	}
+	f.logs[ID] = append(f.logs[ID], fmt.Sprintf("exec %s", request.Command))
+	return SandboxExecResult{ExitCode: 0}, nil
+}
+
+func (f *FakeSandboxClient) DeleteVolume(host string, name string) error {
+	return nil
+}
+
+func (f *FakeSandboxClient) Health(host string) error {
+	return nil
+}
+
+func (f *FakeSandboxClient) setStatus(host string, ID string, status string) (Sandbox, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sandbox, ok := f.sandboxes[host][ID]
+	if !ok {
+		return sandbox, errSandboxNotFound
+	}
+	sandbox.Status = status
+	f.sandboxes[host][ID] = sandbox
+	f.logs[ID] = append(f.logs[ID], status)
+	return sandbox, nil
+}
@@ -3,6 +3,7 @@ module jcs
 go 1.24.0
 
 require (
-	github.com/go-chi/chi/v5 v5.2.3 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/go-chi/chi/v5 v5.2.3
+	github.com/joho/godotenv v1.5.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,11 +2,12 @@ package main
 
 import (
 	"net/http"
+	"net/url"
 	"io"
-	"os"
+	"strconv"
 	"fmt"
-	"log"
 	"bytes"
+	"strings"
 	"encoding/json"
 )
 
@@ -18,19 +19,51 @@ type HetznerPublicNetResponse struct {
 	IPV4 HetznerIPV4Response `json:"ipv4"`
 }
 
+type HetznerServerTypeResponse struct {
+	Name string `json:"name"`
+	Cores int `json:"cores"`
+	Memory float64 `json:"memory"`
+	// Disk is in GB.
+	Disk int `json:"disk"`
+}
+
+type HetznerLocationResponse struct {
+	Name string `json:"name"`
+}
+
+type HetznerDatacenterResponse struct {
+	Location HetznerLocationResponse `json:"location"`
+}
+
 type HetznerServer struct {
 	ID int `json:"id"`
 	Name   string `json:"name"`
 	Status string `json:"status"`
 	PublicNet HetznerPublicNetResponse `json:"public_net"`
+	ServerType HetznerServerTypeResponse `json:"server_type"`
+	Datacenter HetznerDatacenterResponse `json:"datacenter"`
+	Labels map[string]string `json:"labels"`
 }
 
 type HetznerListServersResponse struct {
 	Servers []HetznerServer `json:"servers"`
+	Meta HetznerMeta `json:"meta"`
+}
+
+// HetznerMeta comes with list responses; NextPage is nil on the last page.
+type HetznerMeta struct {
+	Pagination struct {
+		Page int `json:"page"`
+		PerPage int `json:"per_page"`
+		NextPage *int `json:"next_page"`
+		LastPage *int `json:"last_page"`
+		TotalEntries *int `json:"total_entries"`
+	} `json:"pagination"`
 }
 
 type HetznerCreateServerResponse struct {
 	Server HetznerServer `json:"server"`
+	Action HetznerAction `json:"action"`
 }
 
 type HetznerGetServerResponse struct {
@@ -41,116 +74,240 @@ type HetznerCreateServerRequest struct {
 	Name string `json:"name"`
 	ServerType string `json:"server_type"`
 	Image string `json:"image"`
+	Location string `json:"location,omitempty"`
+	UserData string `json:"user_data,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// HetznerVolume is a block storage volume; Server is nil while it is
+// detached. Size is in GB.
+type HetznerVolume struct {
+	ID int `json:"id"`
+	Name string `json:"name"`
+	Size int `json:"size"`
+	Server *int `json:"server"`
+	Status string `json:"status"`
+	LinuxDevice string `json:"linux_device"`
+	Location HetznerLocationResponse `json:"location"`
+}
+
+type HetznerCreateVolumeRequest struct {
+	Name string `json:"name"`
+	Size int `json:"size"`
+	Server int `json:"server,omitempty"`
+	Location string `json:"location,omitempty"`
+	Automount bool `json:"automount,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+type HetznerCreateVolumeResponse struct {
+	Volume HetznerVolume `json:"volume"`
+	Action HetznerAction `json:"action"`
+	NextActions []HetznerAction `json:"next_actions"`
+}
+
+type HetznerGetVolumeResponse struct {
+	Volume HetznerVolume `json:"volume"`
+}
+
+type HetznerAttachVolumeRequest struct {
+	Server int `json:"server"`
+	Automount bool `json:"automount,omitempty"`
+}
+
+type HetznerAction struct {
+	ID int `json:"id"`
+	Command string `json:"command"`
+	Status string `json:"status"`
+	Progress int `json:"progress"`
+	Error *struct {
+		Code string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type HetznerActionResponse struct {
+	Action HetznerAction `json:"action"`
+}
+
+type HetznerErrorResponse struct {
+	Error struct {
+		Code string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
 }
 
 type HetznerApiClient struct {
+	baseURL string
+	token string
+	httpClient *http.Client
+}
+
+// NewHetznerApiClient talks to the Hetzner Cloud API at baseURL (normally
+// https://api.hetzner.cloud/v1) with token. A nil httpClient means
+// http.DefaultClient.
+func NewHetznerApiClient(baseURL string, token string, httpClient *http.Client) *HetznerApiClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HetznerApiClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token: token,
+		httpClient: httpClient,
+	}
 }
 
 func (api *HetznerApiClient) GetServer(serverID string) (HetznerGetServerResponse, error) {
 	var result HetznerGetServerResponse
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://api.hetzner.cloud/v1/servers/%s", serverID), nil)
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-		return result, err
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("HETZNER_API_KEY")))
+	err := api.do(http.MethodGet, api.baseURL+"/servers/"+serverID, nil, &result)
+	return result, err
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Error making request: %v", err)
-		return result, err
-	}
-	defer resp.Body.Close()
+// hetznerPageSize is the most items Hetzner returns per page.
+const hetznerPageSize = 50
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
-		return result, err
+// ListServers lists the servers matching labelSelector, e.g.
+// "managed-by=jcs"; an empty selector lists every server in the project. It
+// follows the pagination until the last page, so Servers holds them all.
+func (api *HetznerApiClient) ListServers(labelSelector string) (HetznerListServersResponse, error) {
+	var result HetznerListServersResponse
+	query := url.Values{}
+	if labelSelector != "" {
+		query.Set("label_selector", labelSelector)
 	}
-
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		log.Fatalf("error unmarshalling JSON: %v", err)
-		return result, err
+	query.Set("per_page", strconv.Itoa(hetznerPageSize))
+	for page := 1; ; {
+		query.Set("page", strconv.Itoa(page))
+		var pageResult HetznerListServersResponse
+		if err := api.do(http.MethodGet, api.baseURL+"/servers?"+query.Encode(), nil, &pageResult); err != nil {
+			return result, err
+		}
+		result.Servers = append(result.Servers, pageResult.Servers...)
+		result.Meta = pageResult.Meta
+		next := pageResult.Meta.Pagination.NextPage
+		if next == nil || *next <= page {
+			return result, nil
+		}
+		page = *next
 	}
+}
 
-	return result, nil
+func (api *HetznerApiClient) CreateServer(name string, serverType string, image string, location string, userData string, labels map[string]string) (HetznerCreateServerResponse, error) {
+	var result HetznerCreateServerResponse
+	requestBody := HetznerCreateServerRequest{Name: name, ServerType: serverType, Image: image, Location: location, UserData: userData, Labels: labels}
+	err := api.do(http.MethodPost, api.baseURL+"/servers", requestBody, &result)
+	return result, err
 }
 
-func (api *HetznerApiClient) ListServers() (HetznerListServersResponse, error) {
-	var result HetznerListServersResponse
+func (api *HetznerApiClient) DeleteServer(serverID string) (HetznerActionResponse, error) {
+	var result HetznerActionResponse
+	err := api.do(http.MethodDelete, api.baseURL+"/servers/"+serverID, nil, &result)
+	return result, err
+}
 
-    apiKey := os.Getenv("HETZNER_API_KEY")
-    if apiKey == "" {
-        log.Fatalf("HETZNER_API_KEY not set!")
-        return result, fmt.Errorf("HETZNER_API_KEY not set")
-    }
+// CreateVolume creates a volume of sizeGB attached to serverID. With
+// automount, Hetzner formats it and mounts it at /mnt/HC_Volume_{id}.
+func (api *HetznerApiClient) CreateVolume(name string, sizeGB int, serverID int, automount bool, format string) (HetznerCreateVolumeResponse, error) {
+	var result HetznerCreateVolumeResponse
+	requestBody := HetznerCreateVolumeRequest{Name: name, Size: sizeGB, Server: serverID, Automount: automount, Format: format}
+	err := api.do(http.MethodPost, api.baseURL+"/volumes", requestBody, &result)
+	return result, err
+}
 
-	req, err := http.NewRequest(http.MethodGet, "https://api.hetzner.cloud/v1/servers", nil)
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-		return result, err
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+func (api *HetznerApiClient) GetVolume(volumeID string) (HetznerGetVolumeResponse, error) {
+	var result HetznerGetVolumeResponse
+	err := api.do(http.MethodGet, api.baseURL+"/volumes/"+volumeID, nil, &result)
+	return result, err
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Error making request: %v", err)
-		return result, err
-	}
-	defer resp.Body.Close()
+// DeleteVolume deletes a detached volume.
+func (api *HetznerApiClient) DeleteVolume(volumeID string) error {
+	return api.do(http.MethodDelete, api.baseURL+"/volumes/"+volumeID, nil, nil)
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
-		return result, err
-	}
+func (api *HetznerApiClient) AttachVolume(volumeID string, serverID int, automount bool) (HetznerActionResponse, error) {
+	var result HetznerActionResponse
+	requestBody := HetznerAttachVolumeRequest{Server: serverID, Automount: automount}
+	err := api.do(http.MethodPost, api.baseURL+"/volumes/"+volumeID+"/actions/attach", requestBody, &result)
+	return result, err
+}
 
-	err = json.Unmarshal(body, &result)
+func (api *HetznerApiClient) DetachVolume(volumeID string) (HetznerActionResponse, error) {
+	var result HetznerActionResponse
+	err := api.do(http.MethodPost, api.baseURL+"/volumes/"+volumeID+"/actions/detach", nil, &result)
+	return result, err
+}
 
-	if err != nil {
-		log.Fatalf("error unmarshalling JSON: %v", err)
-		return result, err
-	}
+func (api *HetznerApiClient) GetAction(actionID int) (HetznerActionResponse, error) {
+	var result HetznerActionResponse
+	err := api.do(http.MethodGet, fmt.Sprintf("%s/actions/%d", api.baseURL, actionID), nil, &result)
+	return result, err
+}
 
-	return result, nil
-} 
+// do sends body as JSON and decodes the response into result, turning
+// Hetzner's error responses into typed errors.
+func (api *HetznerApiClient) do(method string, url string, body any, result any) error {
+	var requestBody io.Reader
+	if body != nil {
+		jsonBody, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewBuffer(jsonBody)
+	}
 
-func (api *HetznerApiClient) CreateServer(name string, serverType string, image string) (HetznerCreateServerResponse, error) {
-	var result HetznerCreateServerResponse
-	requestBody := HetznerCreateServerRequest{Name: name, ServerType: serverType, Image: image}
-	jsonBody, err := json.Marshal(requestBody)
+	req, err := http.NewRequest(method, url, requestBody)
 	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
-		return result, err
+		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, "https://api.hetzner.cloud/v1/servers", bytes.NewBuffer(jsonBody))
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-		return result, err
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", api.token))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("HETZNER_API_KEY")))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := api.httpClient.Do(req)
 	if err != nil {
-		log.Fatalf("Error making request: %v", err)
-		return result, err
+		return ProviderUnavailableError(err, "Error reaching the Hetzner API")
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
-		return result, err
+		return ProviderUnavailableError(err, "Error reading Hetzner API response")
 	}
-	err = json.Unmarshal(body, &result)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return hetznerError(resp.StatusCode, responseBody)
+	}
+
+	if result == nil || len(responseBody) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(responseBody, result)
 	if err != nil {
-		log.Fatalf("error unmarshalling JSON: %v", err)
-		return result, err
+		return ProviderUnavailableError(err, "Error decoding Hetzner API response")
 	}
 
-	return result, nil
+	return nil
+}
+
+func hetznerError(statusCode int, body []byte) error {
+	var errorResponse HetznerErrorResponse
+	json.Unmarshal(body, &errorResponse)
+	message := errorResponse.Error.Message
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		return NotFoundError("Hetzner: %s", message)
+	case statusCode == http.StatusConflict || errorResponse.Error.Code == "uniqueness_error":
+		return ConflictError("Hetzner: %s", message)
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return ProviderUnavailableError(nil, "Hetzner returned %d: %s", statusCode, message)
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return newError(ErrInternal, nil, "Hetzner rejected the API key: %s", message)
+	}
+	return ValidationError("Hetzner rejected the request: %s", message)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"jcs/internal/hetznerfake"
+)
+
+// newTestHetzner serves a fresh hetznerfake and returns a client for it.
+func newTestHetzner(t *testing.T) (*hetznerfake.Fake, *HetznerApiClient) {
+	t.Helper()
+	fake := hetznerfake.New("test-token")
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	return fake, NewHetznerApiClient(hetznerfake.URL(server), "test-token", server.Client())
+}
+
+func TestHetznerListServersFollowsPages(t *testing.T) {
+	_, api := newTestHetzner(t)
+	owned := map[string]string{hetznerOwnerLabel: hetznerOwner}
+	for i := 0; i < 2*hetznerPageSize+5; i++ {
+		if _, err := api.CreateServer(fmt.Sprintf("jcs-%d", i), "cx22", "ubuntu-24.04", "", "", owned); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := api.CreateServer(fmt.Sprintf("other-%d", i), "cx22", "ubuntu-24.04", "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed, err := api.ListServers(hetznerOwnerLabel + "=" + hetznerOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, server := range listed.Servers {
+		if server.Labels[hetznerOwnerLabel] != hetznerOwner {
+			t.Errorf("listed server '%s' without the owner label", server.Name)
+		}
+		seen[server.ID] = true
+	}
+	if len(listed.Servers) != 2*hetznerPageSize+5 || len(seen) != len(listed.Servers) {
+		t.Errorf("listed %d servers (%d distinct), want %d", len(listed.Servers), len(seen), 2*hetznerPageSize+5)
+	}
+
+	all, err := api.ListServers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Servers) != 2*hetznerPageSize+8 {
+		t.Errorf("listed %d servers without a selector, want %d", len(all.Servers), 2*hetznerPageSize+8)
+	}
+}
+
+func TestHetznerErrors(t *testing.T) {
+	fake, api := newTestHetzner(t)
+
+	fake.FailNext(http.MethodGet, "/v1/servers", hetznerfake.Failure{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "try again later"})
+	if _, err := api.ListServers(""); KindOf(err) != ErrProviderUnavailable {
+		t.Errorf("503: got %v, want a provider unavailable error", err)
+	}
+	fake.FailNext(http.MethodPost, "/v1/servers", hetznerfake.Failure{Status: http.StatusTooManyRequests, Code: "rate_limit_exceeded", Message: "slow down"})
+	if _, err := api.CreateServer("jcs-a", "cx22", "ubuntu-24.04", "", "", nil); KindOf(err) != ErrProviderUnavailable {
+		t.Errorf("429: got %v, want a provider unavailable error", err)
+	}
+
+	if _, err := api.GetServer("12345"); !IsNotFound(err) {
+		t.Errorf("unknown server: got %v, want not found", err)
+	}
+	if _, err := api.CreateServer("jcs-a", "cx22", "ubuntu-24.04", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.CreateServer("jcs-a", "cx22", "ubuntu-24.04", "", "", nil); KindOf(err) != ErrConflict {
+		t.Errorf("duplicate name: got %v, want a conflict", err)
+	}
+	if _, err := api.CreateServer("jcs-b", "huge", "ubuntu-24.04", "", "", nil); KindOf(err) != ErrValidation {
+		t.Errorf("unknown server type: got %v, want a validation error", err)
+	}
+
+	fake.Token = "rotated"
+	if _, err := api.ListServers(""); KindOf(err) != ErrInternal {
+		t.Errorf("bad token: got %v, want an internal error", err)
+	}
+}
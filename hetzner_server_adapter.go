@@ -1,46 +1,168 @@
 package main
 
 import (
+	"errors"
+	"log"
 	"strconv"
+	"time"
 )
 
 type HetznerServerAdapter struct {
+	Config HetznerConfig
+	Bootstrap BootstrapConfig
+	api *HetznerApiClient
+}
+
+// Servers jcs creates carry the ownership label, and only those are listed:
+// anything else in the project is none of jcs's business, and must never be
+// reaped.
+const (
+	hetznerOwnerLabel = "managed-by"
+	hetznerOwner      = "jcs"
+)
+
+func NewHetznerServerAdapter(config HetznerConfig, bootstrap BootstrapConfig, api *HetznerApiClient) HetznerServerAdapter {
+	return HetznerServerAdapter{Config: config, Bootstrap: bootstrap, api: api}
 }
 
 func (h HetznerServerAdapter) ListServers() ([]RemoteServer, error) {
 	result := []RemoteServer{}
-	api := HetznerApiClient{}
-	listServersResponse, err := api.ListServers()
+	listServersResponse, err := h.api.ListServers(hetznerOwnerLabel + "=" + hetznerOwner)
 	if err != nil {
 		return result, err
 	}
 	for _, serverData := range listServersResponse.Servers {
-		server := RemoteServer{ID: strconv.Itoa(serverData.ID), Type: "hetzner", Status: serverData.Status, IP: serverData.PublicNet.IPV4.IP}
-		result = append(result, server)
+		result = append(result, remoteServerFromHetzner(serverData))
 	}
 	return result, nil
 }
 
 func (h HetznerServerAdapter) GetServer(ID string) (RemoteServer, error) {
 	var result RemoteServer
-	api := HetznerApiClient{}
-	getServerResponse, err := api.GetServer(ID)
+	getServerResponse, err := h.api.GetServer(ID)
 	if err != nil {
 		return result, err
 	}
-	hetznerServer := getServerResponse.Server
-	result = RemoteServer{ID: strconv.Itoa(hetznerServer.ID), Name: hetznerServer.Name, Type: "hetzner", Status: hetznerServer.Status, IP: hetznerServer.PublicNet.IPV4.IP}
+	result = remoteServerFromHetzner(getServerResponse.Server)
 	return result, nil
 }
 
-func (h HetznerServerAdapter) CreateServer(name string) (RemoteServer, error) {
+func (h HetznerServerAdapter) CreateServer(name string, serverType string, location string, bootstrapToken string) (RemoteServer, error) {
 	var result RemoteServer
-	api := HetznerApiClient{}
-	createServerResponse, err := api.CreateServer(name, "cpx21", "ubuntu-24.04")
+	if serverType == "" {
+		serverType = h.Config.ServerType
+	}
+	if location == "" {
+		location = h.Config.Location
+	}
+	userData, err := renderUserData(h.Bootstrap, name, serverType, bootstrapToken)
 	if err != nil {
 		return result, err
 	}
-	hetznerServer := createServerResponse.Server
-	result = RemoteServer{ID: strconv.Itoa(hetznerServer.ID), Name: hetznerServer.Name, Type: "hetzner", Status: hetznerServer.Status, IP: hetznerServer.PublicNet.IPV4.IP}
+	labels := map[string]string{hetznerOwnerLabel: hetznerOwner}
+	createServerResponse, err := h.api.CreateServer(name, serverType, h.Config.Image, location, userData, labels)
+	if err != nil {
+		return result, err
+	}
+	server, err := h.waitUntilRunning(createServerResponse)
+	if err != nil {
+		// Don't leave a half-created server running up the bill
+		if _, deleteErr := h.api.DeleteServer(strconv.Itoa(createServerResponse.Server.ID)); deleteErr != nil && !IsNotFound(deleteErr) {
+			log.Printf("Error deleting Hetzner server %d after a failed create: %v", createServerResponse.Server.ID, deleteErr)
+		}
+		return result, err
+	}
+	result = remoteServerFromHetzner(server)
 	return result, nil
 }
+
+// waitUntilRunning polls the action Hetzner returned for a new server until it
+// finishes, then the server itself until it is running.
+func (h HetznerServerAdapter) waitUntilRunning(created HetznerCreateServerResponse) (HetznerServer, error) {
+	timeout := time.Duration(h.Config.ReadyTimeoutSeconds) * time.Second
+	interval := time.Duration(h.Config.PollIntervalSeconds) * time.Second
+	serverID := strconv.Itoa(created.Server.ID)
+
+	if created.Action.ID != 0 {
+		if err := waitForHetznerAction(h.api, h.Config, created.Action.ID, "create server "+serverID); err != nil {
+			return HetznerServer{}, err
+		}
+	}
+
+	server := created.Server
+	var lastErr error
+	err := waitFor(timeout, interval, func() (bool, error) {
+		getServerResponse, err := h.api.GetServer(serverID)
+		if transient(err) {
+			lastErr = err
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		server = getServerResponse.Server
+		return server.Status == "running", nil
+	})
+	if errors.Is(err, errWaitTimedOut) {
+		if lastErr != nil {
+			err = lastErr
+		}
+		return server, ProviderUnavailableError(err, "Timed out waiting for Hetzner server %s to start, it is still %s", serverID, server.Status)
+	}
+	return server, err
+}
+
+// waitForHetznerAction polls an action until it finishes. description says
+// what the action does, for errors. Polls that fail on the way are retried
+// until the timeout; only Hetzner rejecting the request or failing the
+// action ends the wait early.
+func waitForHetznerAction(api *HetznerApiClient, config HetznerConfig, actionID int, description string) error {
+	timeout := time.Duration(config.ReadyTimeoutSeconds) * time.Second
+	interval := time.Duration(config.PollIntervalSeconds) * time.Second
+	var lastErr error
+	err := waitFor(timeout, interval, func() (bool, error) {
+		actionResponse, err := api.GetAction(actionID)
+		if transient(err) {
+			lastErr = err
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		action := actionResponse.Action
+		if action.Status == "error" {
+			message := "unknown error"
+			if action.Error != nil {
+				message = action.Error.Message
+			}
+			return false, ProviderUnavailableError(nil, "Hetzner failed to %s: %s", description, message)
+		}
+		return action.Status == "success", nil
+	})
+	if errors.Is(err, errWaitTimedOut) {
+		if lastErr != nil {
+			err = lastErr
+		}
+		return ProviderUnavailableError(err, "Timed out waiting for Hetzner to %s", description)
+	}
+	return err
+}
+
+func (h HetznerServerAdapter) DeleteServer(ID string) error {
+	_, err := h.api.DeleteServer(ID)
+	return err
+}
+
+func remoteServerFromHetzner(hetznerServer HetznerServer) RemoteServer {
+	return RemoteServer{
+		ID: strconv.Itoa(hetznerServer.ID),
+		Name: hetznerServer.Name,
+		Type: "hetzner",
+		ServerType: hetznerServer.ServerType.Name,
+		Location: hetznerServer.Datacenter.Location.Name,
+		Capacity: Resources{CPU: float64(hetznerServer.ServerType.Cores), MemoryMB: int(hetznerServer.ServerType.Memory * 1024), DiskMB: hetznerServer.ServerType.Disk * 1024},
+		Status: hetznerServer.Status,
+		IP: hetznerServer.PublicNet.IPV4.IP,
+		Owned: hetznerServer.Labels[hetznerOwnerLabel] == hetznerOwner,
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"jcs/internal/hetznerfake"
+)
+
+func newTestHetznerAdapter(t *testing.T) (HetznerServerAdapter, *HetznerApiClient) {
+	t.Helper()
+	_, api := newTestHetzner(t)
+	config := HetznerConfig{ServerType: "cpx21", Image: "ubuntu-24.04", PollIntervalSeconds: 0, ReadyTimeoutSeconds: 5}
+	return NewHetznerServerAdapter(config, BootstrapConfig{AgentURL: "https://example.com/jcs-agent"}, api), api
+}
+
+func TestHetznerAdapterCreatesOwnedServers(t *testing.T) {
+	adapter, api := newTestHetznerAdapter(t)
+	if _, err := api.CreateServer("not-ours", "cx22", "ubuntu-24.04", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := adapter.CreateServer("jcs-a", "", "", "one-time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != "running" || !created.Owned || created.ServerType != "cpx21" || created.Capacity.CPU != 3 || created.IP == "" {
+		t.Errorf("created %+v, want a running, owned cpx21 server with an IP", created)
+	}
+	remote, err := api.GetServer(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Server.Labels[hetznerOwnerLabel] != hetznerOwner {
+		t.Errorf("server labels = %v, want the owner label", remote.Server.Labels)
+	}
+
+	// Servers jcs didn't create are none of its business
+	listed, err := adapter.ListServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != created.ID {
+		t.Errorf("listed %+v, want only '%s'", listed, created.ID)
+	}
+
+	if err := adapter.DeleteServer(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adapter.GetServer(created.ID); !IsNotFound(err) {
+		t.Errorf("deleted server: got %v, want not found", err)
+	}
+}
+
+func TestHetznerAdapterDeletesFailedCreates(t *testing.T) {
+	fake, api := newTestHetzner(t)
+	fake.FailActions = true
+	adapter := NewHetznerServerAdapter(HetznerConfig{ServerType: "cpx21", Image: "ubuntu-24.04", ReadyTimeoutSeconds: 5}, BootstrapConfig{}, api)
+
+	if _, err := adapter.CreateServer("jcs-a", "", "", "one-time"); KindOf(err) != ErrProviderUnavailable {
+		t.Fatalf("got %v, want a provider unavailable error", err)
+	}
+	if servers := fake.Servers(); len(servers) != 0 {
+		t.Errorf("failed create left %+v behind", servers)
+	}
+}
+
+func TestHetznerVolumeLifecycle(t *testing.T) {
+	fake, api := newTestHetzner(t)
+	config := HetznerConfig{ServerType: "cpx21", Image: "ubuntu-24.04", ReadyTimeoutSeconds: 5}
+	adapter := NewHetznerServerAdapter(config, BootstrapConfig{}, api)
+	driver := hetznerVolumeDriver{config: config, api: api}
+	remote, err := adapter.CreateServer("jcs-a", "", "", "one-time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServerFromRemote(remote, "abc")
+
+	volume, err := driver.Attach(Volume{ID: "data", Name: "data", Driver: "hetzner", SizeGB: 10}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes := fake.Volumes()
+	if volume.RemoteID == "" || volume.ServerID != server.ID || len(volumes) != 1 || volumes[0].Server == nil || strconv.Itoa(*volumes[0].Server) != remote.ID {
+		t.Fatalf("attached %+v, fake has %+v", volume, volumes)
+	}
+	if path := driver.HostPath(volume); path != "/mnt/HC_Volume_"+volume.RemoteID {
+		t.Errorf("host path %q", path)
+	}
+
+	if volume, err = driver.Detach(volume); err != nil {
+		t.Fatal(err)
+	}
+	if volumes := fake.Volumes(); volume.ServerID != "" || volumes[0].Server != nil {
+		t.Fatalf("detached %+v, fake has %+v", volume, volumes)
+	}
+	// Attaching again reuses the volume
+	if volume, err = driver.Attach(volume, server); err != nil {
+		t.Fatal(err)
+	}
+	if volumes := fake.Volumes(); len(volumes) != 1 || volumes[0].Server == nil {
+		t.Fatalf("reattached %+v, fake has %+v", volume, volumes)
+	}
+
+	// Deleting detaches it first
+	if err := driver.Delete(volume); err != nil {
+		t.Fatal(err)
+	}
+	if volumes := fake.Volumes(); len(volumes) != 0 {
+		t.Errorf("deleted volume is still there: %+v", volumes)
+	}
+}
+
+func TestHetznerWaitsThroughTransientErrors(t *testing.T) {
+	fake, api := newTestHetzner(t)
+	adapter := NewHetznerServerAdapter(HetznerConfig{ServerType: "cpx21", Image: "ubuntu-24.04", ReadyTimeoutSeconds: 5}, BootstrapConfig{}, api)
+	created, err := api.CreateServer("jcs-a", "cpx21", "ubuntu-24.04", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actionPath := "/v1/actions/" + strconv.Itoa(created.Action.ID)
+	serverPath := "/v1/servers/" + strconv.Itoa(created.Server.ID)
+	fake.FailNext(http.MethodGet, actionPath, hetznerfake.Failure{Status: http.StatusBadGateway, Code: "unavailable", Message: "bad gateway"})
+	fake.FailNext(http.MethodGet, actionPath, hetznerfake.Failure{Status: http.StatusTooManyRequests, Code: "rate_limit_exceeded", Message: "slow down"})
+	fake.FailNext(http.MethodGet, serverPath, hetznerfake.Failure{Status: http.StatusServiceUnavailable, Code: "unavailable", Message: "try again later"})
+
+	server, err := adapter.waitUntilRunning(created)
+	if err != nil {
+		t.Fatalf("a few failed polls ended the wait: %v", err)
+	}
+	if server.Status != "running" {
+		t.Errorf("server is %s, want running", server.Status)
+	}
+}
+
+func TestHetznerStopsWaitingWhenRejected(t *testing.T) {
+	fake, api := newTestHetzner(t)
+	created, err := api.CreateServer("jcs-a", "cpx21", "ubuntu-24.04", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.FailNext(http.MethodGet, "/v1/actions/"+strconv.Itoa(created.Action.ID), hetznerfake.Failure{Status: http.StatusNotFound, Code: "not_found", Message: "no such action"})
+
+	start := time.Now()
+	err = waitForHetznerAction(api, HetznerConfig{ReadyTimeoutSeconds: 5, PollIntervalSeconds: 1}, created.Action.ID, "create server")
+	if !IsNotFound(err) {
+		t.Errorf("got %v, want the not found error", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("kept polling for %s after Hetzner rejected the request", time.Since(start))
+	}
+}
@@ -0,0 +1,580 @@
+// Package hetznerfake emulates the parts of the Hetzner Cloud API jcs uses:
+// servers, volumes, the actions that create, attach and delete them, and its
+// error responses.
+// Point HetznerApiClient at URL() to exercise the Hetzner adapter offline.
+package hetznerfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ServerType is a server size the fake accepts.
+type ServerType struct {
+	Name   string  `json:"name"`
+	Cores  int     `json:"cores"`
+	Memory float64 `json:"memory"`
+	Disk   int     `json:"disk"`
+}
+
+// ServerTypes are the sizes the fake knows; creating any other is rejected.
+var ServerTypes = map[string]ServerType{
+	"cx22":  {Name: "cx22", Cores: 2, Memory: 4, Disk: 40},
+	"cpx11": {Name: "cpx11", Cores: 2, Memory: 2, Disk: 40},
+	"cpx21": {Name: "cpx21", Cores: 3, Memory: 4, Disk: 80},
+	"cpx31": {Name: "cpx31", Cores: 4, Memory: 8, Disk: 160},
+	"cpx41": {Name: "cpx41", Cores: 8, Memory: 16, Disk: 240},
+}
+
+type Server struct {
+	ID         int               `json:"id"`
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	PublicNet  publicNet         `json:"public_net"`
+	ServerType ServerType        `json:"server_type"`
+	Datacenter datacenter        `json:"datacenter"`
+	Labels     map[string]string `json:"labels"`
+	Image      string            `json:"-"`
+	// UserData is the cloud-init the server was created with.
+	UserData string `json:"-"`
+}
+
+type publicNet struct {
+	IPV4 struct {
+		IP string `json:"ip"`
+	} `json:"ipv4"`
+}
+
+type datacenter struct {
+	Location struct {
+		Name string `json:"name"`
+	} `json:"location"`
+}
+
+// Volume is a block storage volume. Server is nil while it is detached.
+type Volume struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Size        int    `json:"size"`
+	Server      *int   `json:"server"`
+	Status      string `json:"status"`
+	LinuxDevice string `json:"linux_device"`
+	Format      string `json:"format"`
+	Location    struct {
+		Name string `json:"name"`
+	} `json:"location"`
+}
+
+type Action struct {
+	ID       int          `json:"id"`
+	Command  string       `json:"command"`
+	Status   string       `json:"status"`
+	Progress int          `json:"progress"`
+	Error    *ActionError `json:"error"`
+
+	serverID int
+	// succeed applies a volume action's effect once it finishes.
+	succeed func()
+	// polls counts how often the action was fetched while running.
+	polls int
+}
+
+type ActionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Failure is an error response the fake returns instead of handling a request.
+type Failure struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Fake holds the emulated project's state. Its exported fields may be changed
+// between requests.
+type Fake struct {
+	// Token is the API token requests must carry.
+	Token string
+	// ActionPolls is how many times an action is reported as running before
+	// it succeeds.
+	ActionPolls int
+	// FailActions makes create_server actions end in an error.
+	FailActions bool
+
+	mu       sync.Mutex
+	servers  map[int]*Server
+	volumes  map[int]*Volume
+	actions  map[int]*Action
+	failures map[string][]Failure
+	nextID   int
+}
+
+func New(token string) *Fake {
+	return &Fake{
+		Token:       token,
+		ActionPolls: 1,
+		servers:     make(map[int]*Server),
+		volumes:     make(map[int]*Volume),
+		actions:     make(map[int]*Action),
+		failures:    make(map[string][]Failure),
+		nextID:      1,
+	}
+}
+
+// Start serves the fake on a local httptest server. Close it when done.
+func (f *Fake) Start() *httptest.Server {
+	return httptest.NewServer(f)
+}
+
+// URL is the base URL for a client talking to the fake served by server.
+func URL(server *httptest.Server) string {
+	return server.URL + "/v1"
+}
+
+// FailNext makes the next request matching method and path (e.g. "POST",
+// "/v1/servers") fail with failure. Failures queue up per route.
+func (f *Fake) FailNext(method string, path string, failure Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := method + " " + path
+	f.failures[key] = append(f.failures[key], failure)
+}
+
+// Servers returns a copy of every server in the project.
+func (f *Fake) Servers() []Server {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	servers := make([]Server, 0, len(f.servers))
+	for _, server := range f.servers {
+		servers = append(servers, *server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	return servers
+}
+
+// Volumes returns a copy of every volume in the project.
+func (f *Fake) Volumes() []Volume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	volumes := make([]Volume, 0, len(f.volumes))
+	for _, volume := range f.volumes {
+		volumes = append(volumes, *volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+f.Token {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "unable to authenticate")
+		return
+	}
+	key := r.Method + " " + r.URL.Path
+	if queued := f.failures[key]; len(queued) > 0 {
+		f.failures[key] = queued[1:]
+		writeError(w, queued[0].Status, queued[0].Code, queued[0].Message)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "servers" && r.Method == http.MethodGet:
+		f.listServers(w, r)
+	case path == "servers" && r.Method == http.MethodPost:
+		f.createServer(w, r)
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodGet:
+		f.getServer(w, parts[1])
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodDelete:
+		f.deleteServer(w, parts[1])
+	case path == "volumes" && r.Method == http.MethodGet:
+		f.listVolumes(w, r)
+	case path == "volumes" && r.Method == http.MethodPost:
+		f.createVolume(w, r)
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodGet:
+		f.getVolume(w, parts[1])
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodDelete:
+		f.deleteVolume(w, parts[1])
+	case len(parts) == 4 && parts[0] == "volumes" && parts[2] == "actions" && parts[3] == "attach" && r.Method == http.MethodPost:
+		f.attachVolume(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "volumes" && parts[2] == "actions" && parts[3] == "detach" && r.Method == http.MethodPost:
+		f.detachVolume(w, parts[1])
+	case len(parts) == 2 && parts[0] == "actions" && r.Method == http.MethodGet:
+		f.getAction(w, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %s not found", r.Method, r.URL.Path))
+	}
+}
+
+// listServers supports label selectors of the form "key=value" or "key", and
+// pagination.
+func (f *Fake) listServers(w http.ResponseWriter, r *http.Request) {
+	key, value, hasValue := strings.Cut(r.URL.Query().Get("label_selector"), "=")
+	servers := []*Server{}
+	for _, server := range f.servers {
+		if label, ok := server.Labels[key]; key != "" && (!ok || hasValue && label != value) {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	page, meta, ok := paginate(w, r, len(servers))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"servers": servers[page.start:page.end], "meta": meta})
+}
+
+// PerPage and MaxPerPage are the page sizes of list responses: the default
+// and the most a client may ask for.
+const (
+	PerPage    = 25
+	MaxPerPage = 50
+)
+
+type pageBounds struct {
+	start, end int
+}
+
+// paginate reads the page and per_page parameters like the real API and
+// returns which of total items to send, with the meta to send along.
+func paginate(w http.ResponseWriter, r *http.Request, total int) (pageBounds, map[string]any, bool) {
+	page, perPage := 1, PerPage
+	if raw := r.URL.Query().Get("page"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_input", "page must be a positive integer")
+			return pageBounds{}, nil, false
+		}
+		page = parsed
+	}
+	if raw := r.URL.Query().Get("per_page"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > MaxPerPage {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("per_page must be between 1 and %d", MaxPerPage))
+			return pageBounds{}, nil, false
+		}
+		perPage = parsed
+	}
+
+	lastPage := max(1, (total+perPage-1)/perPage)
+	var previousPage, nextPage *int
+	if page > 1 {
+		previous := page - 1
+		previousPage = &previous
+	}
+	if page < lastPage {
+		next := page + 1
+		nextPage = &next
+	}
+	start := min((page-1)*perPage, total)
+	meta := map[string]any{"pagination": map[string]any{
+		"page":          page,
+		"per_page":      perPage,
+		"previous_page": previousPage,
+		"next_page":     nextPage,
+		"last_page":     lastPage,
+		"total_entries": total,
+	}}
+	return pageBounds{start: start, end: min(start+perPage, total)}, meta, true
+}
+
+func (f *Fake) createServer(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name       string            `json:"name"`
+		ServerType string            `json:"server_type"`
+		Image      string            `json:"image"`
+		Location   string            `json:"location"`
+		UserData   string            `json:"user_data"`
+		Labels     map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "json_error", err.Error())
+		return
+	}
+	if request.Name == "" || request.Image == "" {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name and image are required")
+		return
+	}
+	serverType, ok := ServerTypes[request.ServerType]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server type %q not found", request.ServerType))
+		return
+	}
+	for _, server := range f.servers {
+		if server.Name == request.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", "server name is already used")
+			return
+		}
+	}
+
+	server := &Server{ID: f.newID(), Name: request.Name, Status: "initializing", ServerType: serverType, Labels: request.Labels, Image: request.Image, UserData: request.UserData}
+	server.PublicNet.IPV4.IP = fmt.Sprintf("10.0.%d.%d", server.ID/256, server.ID%256)
+	server.Datacenter.Location.Name = request.Location
+	if server.Datacenter.Location.Name == "" {
+		server.Datacenter.Location.Name = "fsn1"
+	}
+	f.servers[server.ID] = server
+
+	action := f.newAction("create_server", server.ID)
+	writeJSON(w, http.StatusCreated, map[string]any{"server": server, "action": action})
+}
+
+func (f *Fake) getServer(w http.ResponseWriter, rawID string) {
+	server, ok := f.lookupServer(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server with ID %q not found", rawID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"server": server})
+}
+
+func (f *Fake) deleteServer(w http.ResponseWriter, rawID string) {
+	server, ok := f.lookupServer(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("server with ID %q not found", rawID))
+		return
+	}
+	delete(f.servers, server.ID)
+	// Deleting a server detaches its volumes
+	for _, volume := range f.volumes {
+		if volume.Server != nil && *volume.Server == server.ID {
+			volume.Server = nil
+		}
+	}
+	action := f.newAction("delete_server", server.ID)
+	action.Status = "success"
+	action.Progress = 100
+	writeJSON(w, http.StatusOK, map[string]any{"action": action})
+}
+
+// getAction advances a running action by one poll, so clients have to wait
+// for it like they would for the real API.
+func (f *Fake) getAction(w http.ResponseWriter, rawID string) {
+	id, err := strconv.Atoi(rawID)
+	action, ok := f.actions[id]
+	if err != nil || !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("action with ID %q not found", rawID))
+		return
+	}
+
+	if action.Status == "running" {
+		action.polls++
+		action.Progress = min(100*action.polls/(f.ActionPolls+1), 99)
+		if action.polls > f.ActionPolls {
+			f.finish(action)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"action": action})
+}
+
+func (f *Fake) finish(action *Action) {
+	server := f.servers[action.serverID]
+	if f.FailActions && action.Command == "create_server" {
+		action.Status = "error"
+		action.Error = &ActionError{Code: "action_failed", Message: "server could not be created"}
+		if server != nil {
+			server.Status = "off"
+		}
+		return
+	}
+	action.Status = "success"
+	action.Progress = 100
+	if action.succeed != nil {
+		action.succeed()
+		return
+	}
+	if server != nil {
+		server.Status = "running"
+	}
+}
+
+func (f *Fake) newAction(command string, serverID int) *Action {
+	action := &Action{ID: f.newID(), Command: command, Status: "running", serverID: serverID}
+	f.actions[action.ID] = action
+	return action
+}
+
+func (f *Fake) listVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes := []*Volume{}
+	for _, volume := range f.volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	page, meta, ok := paginate(w, r, len(volumes))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"volumes": volumes[page.start:page.end], "meta": meta})
+}
+
+// createVolume creates a volume, attaching it right away when a server is
+// given, which is reported as a follow-up action like the real API does.
+func (f *Fake) createVolume(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name      string `json:"name"`
+		Size      int    `json:"size"`
+		Server    int    `json:"server"`
+		Location  string `json:"location"`
+		Automount bool   `json:"automount"`
+		Format    string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "json_error", err.Error())
+		return
+	}
+	if request.Name == "" || request.Size < 10 {
+		writeError(w, http.StatusBadRequest, "invalid_input", "name is required and size must be at least 10 GB")
+		return
+	}
+	if (request.Server == 0) == (request.Location == "") {
+		writeError(w, http.StatusBadRequest, "invalid_input", "exactly one of server and location is required")
+		return
+	}
+	for _, volume := range f.volumes {
+		if volume.Name == request.Name {
+			writeError(w, http.StatusConflict, "uniqueness_error", "volume name is already used")
+			return
+		}
+	}
+	location := request.Location
+	if request.Server != 0 {
+		server, ok := f.servers[request.Server]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server with ID %d not found", request.Server))
+			return
+		}
+		location = server.Datacenter.Location.Name
+	}
+
+	volume := &Volume{ID: f.newID(), Name: request.Name, Size: request.Size, Status: "creating", Format: request.Format}
+	volume.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", volume.ID)
+	volume.Location.Name = location
+	f.volumes[volume.ID] = volume
+
+	action := f.newAction("create_volume", 0)
+	action.succeed = func() { volume.Status = "available" }
+	nextActions := []*Action{}
+	if request.Server != 0 {
+		nextActions = append(nextActions, f.attachAction(volume, request.Server))
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"volume": volume, "action": action, "next_actions": nextActions})
+}
+
+func (f *Fake) getVolume(w http.ResponseWriter, rawID string) {
+	volume, ok := f.lookupVolume(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume with ID %q not found", rawID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"volume": volume})
+}
+
+func (f *Fake) deleteVolume(w http.ResponseWriter, rawID string) {
+	volume, ok := f.lookupVolume(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume with ID %q not found", rawID))
+		return
+	}
+	if volume.Server != nil {
+		writeError(w, http.StatusConflict, "conflict", "volume must be detached before it can be deleted")
+		return
+	}
+	delete(f.volumes, volume.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Fake) attachVolume(w http.ResponseWriter, r *http.Request, rawID string) {
+	volume, ok := f.lookupVolume(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume with ID %q not found", rawID))
+		return
+	}
+	var request struct {
+		Server    int  `json:"server"`
+		Automount bool `json:"automount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "json_error", err.Error())
+		return
+	}
+	server, ok := f.servers[request.Server]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_input", fmt.Sprintf("server with ID %d not found", request.Server))
+		return
+	}
+	if volume.Server != nil {
+		writeError(w, http.StatusConflict, "conflict", "volume is already attached to a server")
+		return
+	}
+	if server.Datacenter.Location.Name != volume.Location.Name {
+		writeError(w, http.StatusBadRequest, "invalid_input", "volume and server must be in the same location")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"action": f.attachAction(volume, server.ID)})
+}
+
+func (f *Fake) detachVolume(w http.ResponseWriter, rawID string) {
+	volume, ok := f.lookupVolume(rawID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("volume with ID %q not found", rawID))
+		return
+	}
+	serverID := 0
+	if volume.Server != nil {
+		serverID = *volume.Server
+	}
+	action := f.newAction("detach_volume", serverID)
+	action.succeed = func() { volume.Server = nil }
+	writeJSON(w, http.StatusCreated, map[string]any{"action": action})
+}
+
+func (f *Fake) attachAction(volume *Volume, serverID int) *Action {
+	action := f.newAction("attach_volume", serverID)
+	action.succeed = func() { volume.Server = &serverID }
+	return action
+}
+
+func (f *Fake) lookupVolume(rawID string) (*Volume, bool) {
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		return nil, false
+	}
+	volume, ok := f.volumes[id]
+	return volume, ok
+}
+
+func (f *Fake) lookupServer(rawID string) (*Server, bool) {
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		return nil, false
+	}
+	server, ok := f.servers[id]
+	return server, ok
+}
+
+func (f *Fake) newID() int {
+	id := f.nextID
+	f.nextID++
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]any{"error": map[string]string{"code": code, "message": message}})
+}
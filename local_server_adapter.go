@@ -1,34 +1,397 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// LocalServerAdapter runs every server as a jcs-agent process on this machine,
+// listening on its own port, so a multi-server cluster can be developed on one
+// laptop. Without an agent binary configured it falls back to a single
+// "localhost" server whose agent is started by hand.
 type LocalServerAdapter struct {
+	config LocalConfig
+	bootstrap BootstrapConfig
 
+	mu sync.Mutex
+	agents map[string]*localAgent
 }
 
-func (l LocalServerAdapter) ListServers() ([]RemoteServer, error) {
-	result := []RemoteServer {
-		RemoteServer{ID: "localhost", Name: "localhost", Type: "local", Status: "online", IP: "localhost"},
+// localAgent is recorded in agents.json in the data directory, so agents are
+// adopted or restarted when the control plane restarts.
+type localAgent struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	ServerType string `json:"server_type"`
+	Port int `json:"port"`
+	Pid int `json:"pid"`
+
+	// done is closed when an agent this process started exits; it is nil
+	// for agents adopted from a previous run.
+	done chan struct{}
+}
+
+func NewLocalServerAdapter(config LocalConfig, bootstrap BootstrapConfig) (*LocalServerAdapter, error) {
+	l := &LocalServerAdapter{
+		config: config,
+		bootstrap: bootstrap,
+		agents: make(map[string]*localAgent),
+	}
+	if config.AgentBinary == "" {
+		return l, nil
 	}
 
+	if err := os.MkdirAll(config.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	contents, err := os.ReadFile(l.statePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(contents) > 0 {
+		agents := []*localAgent{}
+		if err := json.Unmarshal(contents, &agents); err != nil {
+			return nil, fmt.Errorf("Error reading '%s': %v", l.statePath(), err)
+		}
+		for _, agent := range agents {
+			l.agents[agent.ID] = agent
+		}
+	}
+
+	// Agents still running from a previous run are adopted as they are; the
+	// rest are started again with their old data directories
+	for _, agent := range l.agents {
+		if agentHealthy(agent.Port) {
+			continue
+		}
+		if err := l.start(agent); err != nil {
+			log.Printf("Error restarting local agent '%s': %v", agent.Name, err)
+		}
+	}
+	if err := l.save(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LocalServerAdapter) ListServers() ([]RemoteServer, error) {
+	if l.config.AgentBinary == "" {
+		result := []RemoteServer {
+			RemoteServer{ID: "localhost", Name: "localhost", Type: "local", Status: "online", IP: "localhost", Capacity: localCapacity()},
+		}
+
+		return result, nil
+	}
+
+	l.mu.Lock()
+	agents := make([]*localAgent, 0, len(l.agents))
+	for _, agent := range l.agents {
+		agents = append(agents, agent)
+	}
+	l.mu.Unlock()
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Port < agents[j].Port })
+
+	result := make([]RemoteServer, 0, len(agents))
+	for _, agent := range agents {
+		result = append(result, l.remoteServer(agent))
+	}
 	return result, nil
 }
 
-func (l LocalServerAdapter) GetServer(id string) (RemoteServer, error) {
+func (l *LocalServerAdapter) GetServer(id string) (RemoteServer, error) {
 	var result RemoteServer
-	if id != "localhost" {
-		return result, errors.New(fmt.Sprintf("Server not found with ID: '%s'", id))
+	if l.config.AgentBinary == "" {
+		if id != "localhost" {
+			return result, NotFoundError("Server not found with ID: '%s'", id)
+		}
+		result = RemoteServer{ID: "localhost", Name: "localhost", Type: "local", Status: "online", IP: "localhost", Capacity: localCapacity()}
+
+		return result, nil
 	}
-	result = RemoteServer{ID: "localhost", Name: "localhost", Type: "local", Status: "online", IP: "localhost"}
 
-	return result, nil
+	l.mu.Lock()
+	agent, ok := l.agents[id]
+	l.mu.Unlock()
+	if !ok {
+		return result, NotFoundError("Server not found with ID: '%s'", id)
+	}
+	return l.remoteServer(agent), nil
 }
 
-func (l LocalServerAdapter) CreateServer(name string) (RemoteServer, error) {
-	result := RemoteServer{ID: fmt.Sprintf("localhost-%s", name), Name: name, Type: "local", Status: "online", IP: "localhost"}
+// CreateServer starts a new agent on the next free port. The server handler
+// waits for the agent's health check, as it does for real servers. The agent
+// is handed its agent token, so it doesn't use bootstrapToken.
+func (l *LocalServerAdapter) CreateServer(name string, serverType string, location string, bootstrapToken string) (RemoteServer, error) {
+	if l.config.AgentBinary == "" {
+		result := RemoteServer{ID: fmt.Sprintf("localhost-%s", name), Name: name, Type: "local", Status: "online", IP: "localhost", Capacity: localCapacity(), Owned: true}
 
-	return result, nil
+		return result, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	port, err := l.freePort()
+	if err != nil {
+		return RemoteServer{}, err
+	}
+	agent := &localAgent{
+		ID: fmt.Sprintf("localhost-%s", name),
+		Name: name,
+		ServerType: serverType,
+		Port: port,
+	}
+	if err := l.start(agent); err != nil {
+		return RemoteServer{}, err
+	}
+	l.agents[agent.ID] = agent
+	if err := l.save(); err != nil {
+		return RemoteServer{}, err
+	}
+	log.Printf("Started local agent '%s' on port %d", name, port)
+
+	return l.remoteServer(agent), nil
+}
+
+// DeleteServer stops the server's agent and its sandboxes and removes its data
+// directory, like destroying a machine would.
+func (l *LocalServerAdapter) DeleteServer(id string) error {
+	if l.config.AgentBinary == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	agent, ok := l.agents[id]
+	if !ok {
+		return NotFoundError("Server not found with ID: '%s'", id)
+	}
+	// Process sandboxes outlive their agent, so remove them while the agent
+	// is still there to do it
+	if agent.running() {
+		address := fmt.Sprintf("127.0.0.1:%d", agent.Port)
+		client := NewHTTPSandboxClient(30 * time.Second, l.bootstrap.Token)
+		sandboxes, err := client.ListSandboxes(address)
+		if err != nil {
+			return err
+		}
+		for _, sandbox := range sandboxes {
+			if err := client.DeleteSandbox(address, sandbox.ID); err != nil && err != errSandboxNotFound {
+				return err
+			}
+		}
+	}
+	l.stop(agent)
+	dir, err := l.agentDir(agent)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	delete(l.agents, id)
+	return l.save()
+}
+
+// start spawns the agent's process. Callers hold l.mu, or own agent alone.
+func (l *LocalServerAdapter) start(agent *localAgent) error {
+	dir, err := l.agentDir(agent)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "agent.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	// Each agent gets its own slice of sandbox ports, so agents don't race
+	// each other for the same one
+	index := agent.Port - l.config.FirstPort
+	firstSandboxPort := l.config.FirstSandboxPort + index*l.config.SandboxPortsPerServer
+	address := fmt.Sprintf("127.0.0.1:%d", agent.Port)
+	args := []string{
+		"-listen", address,
+		"-address", address,
+		"-name", agent.Name,
+		"-data-dir", filepath.Join(dir, "data"),
+		"-runtime", l.config.Runtime,
+		"-sandbox-ports", fmt.Sprintf("%d-%d", firstSandboxPort, firstSandboxPort+l.config.SandboxPortsPerServer-1),
+	}
+	if l.bootstrap.ControlPlaneURL != "" {
+		args = append(args, "-control-plane", l.bootstrap.ControlPlaneURL)
+	}
+
+	cmd := exec.Command(l.config.AgentBinary, args...)
+	cmd.Env = agentEnv(agentToken(l.bootstrap.Token, address))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("Error starting agent '%s': %v", l.config.AgentBinary, err)
+	}
+	agent.Pid = cmd.Process.Pid
+	agent.done = make(chan struct{})
+	go func(done chan struct{}) {
+		cmd.Wait()
+		logFile.Close()
+		close(done)
+	}(agent.done)
+	return nil
+}
+
+// agentEnv is all an agent process gets of jcs's environment. The agent
+// token goes here rather than on the command line, where ps shows it to
+// everyone. Local agents are handed it up front, so they need no bootstrap
+// token to register with.
+func agentEnv(token string) []string {
+	env := []string{"JCS_AGENT_TOKEN=" + token}
+	// The docker runtime's CLI needs to find the daemon and its config
+	for _, name := range []string{"PATH", "HOME", "DOCKER_HOST", "DOCKER_CONFIG"} {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// stop asks the agent to shut down and kills it if it hasn't after a few
+// seconds. Callers hold l.mu.
+func (l *LocalServerAdapter) stop(agent *localAgent) {
+	process, err := os.FindProcess(agent.Pid)
+	if err != nil {
+		return
+	}
+	if agent.done == nil {
+		// Adopted from a previous run, so not ours to wait on. The pid may
+		// have been reused if the agent is gone
+		if agentHealthy(agent.Port) {
+			process.Kill()
+		}
+		return
+	}
+	process.Signal(os.Interrupt)
+	select {
+	case <-agent.done:
+	case <-time.After(5 * time.Second):
+		process.Kill()
+		<-agent.done
+	}
+}
+
+func (l *LocalServerAdapter) remoteServer(agent *localAgent) RemoteServer {
+	status := "off"
+	if agent.running() {
+		status = "running"
+	}
+	return RemoteServer{
+		ID: agent.ID,
+		Name: agent.Name,
+		Type: "local",
+		ServerType: agent.ServerType,
+		Status: status,
+		IP: fmt.Sprintf("127.0.0.1:%d", agent.Port),
+		Capacity: localCapacity(),
+		Owned: true,
+	}
+}
+
+// freePort finds the first agent port that no agent has and nothing else is
+// listening on. Callers hold l.mu.
+func (l *LocalServerAdapter) freePort() (int, error) {
+	used := make(map[int]bool, len(l.agents))
+	for _, agent := range l.agents {
+		used[agent.Port] = true
+	}
+	for port := l.config.FirstPort; port < l.config.FirstPort+l.config.MaxServers; port++ {
+		if used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			continue
+		}
+		listener.Close()
+		return port, nil
+	}
+	return 0, ConflictError("All %d local servers are in use", l.config.MaxServers)
+}
+
+// agentDir is the agent's directory below DataDir. Names are checked when
+// servers are created, but DeleteServer removes this directory, so it makes
+// sure once more that it stays inside DataDir.
+func (l *LocalServerAdapter) agentDir(agent *localAgent) (string, error) {
+	dir := filepath.Join(l.config.DataDir, agent.Name)
+	relative, err := filepath.Rel(l.config.DataDir, dir)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", ValidationError("Server name '%s' is not a valid directory name", agent.Name)
+	}
+	return dir, nil
+}
+
+func (l *LocalServerAdapter) statePath() string {
+	return filepath.Join(l.config.DataDir, "agents.json")
+}
+
+// save records the agents. Callers hold l.mu.
+func (l *LocalServerAdapter) save() error {
+	agents := make([]*localAgent, 0, len(l.agents))
+	for _, agent := range l.agents {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Port < agents[j].Port })
+	contents, err := json.MarshalIndent(agents, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.statePath())
+}
+
+// running reports whether the agent's process is up. Adopted agents aren't
+// our children, so they are asked instead.
+func (a *localAgent) running() bool {
+	if a.done == nil {
+		return agentHealthy(a.Port)
+	}
+	select {
+	case <-a.done:
+		return false
+	default:
+		return true
+	}
+}
+
+var localHealthClient = &http.Client{Timeout: time.Second}
+
+func agentHealthy(port int) bool {
+	resp, err := localHealthClient.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// localCapacity reports this machine's cores; memory is left to the
+// scheduler's configured server capacity.
+func localCapacity() Resources {
+	return Resources{CPU: float64(runtime.NumCPU())}
 }
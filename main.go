@@ -11,8 +11,9 @@ import (
 	"net/http"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/joho/godotenv"
 	"encoding/json"
+	"io"
+	"strings"
 )
 
 type Server struct {
@@ -20,16 +21,40 @@ type Server struct {
 	Name   string `json:"name"`
 	RemoteID string `json:"remote_id"`
 	Type string `json:"type"`
+	ServerType string `json:"server_type,omitempty"`
+	Location string `json:"location,omitempty"`
+	Capacity Resources `json:"capacity"`
 	Status string `json:"status"`
+	Cordoned bool `json:"cordoned"`
 	IP string `json:"ip"`
+	SSHHostKeys []string `json:"ssh_host_keys,omitempty"`
+	AgentVersion string `json:"agent_version,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	SandboxIDs []string `json:"sandbox_ids,omitempty"`
+	// OrphanedSandboxIDs are the sandboxes of lost containers that were
+	// replaced elsewhere, deleted once the server answers again.
+	OrphanedSandboxIDs []string `json:"orphaned_sandbox_ids,omitempty"`
+	// Owned is true for servers jcs created at their provider, which are
+	// the only ones it may deprovision.
+	Owned bool `json:"owned"`
 }
 
 type RemoteServer struct {
 	ID     string    `json:"id"`
 	Name   string `json:"name"`
 	Type string `json:"type"`
+	ServerType string `json:"server_type,omitempty"`
+	Location string `json:"location,omitempty"`
+	Capacity Resources `json:"capacity"`
 	Status string `json:"status"`
 	IP string `json:"ip"`
+	Owned bool `json:"owned"`
+}
+
+type ServerCreateRequest struct {
+	Name string `json:"name"`
+	ServerType string `json:"server_type,omitempty"`
+	Location string `json:"location,omitempty"`
 }
 
 type Sandbox struct {
@@ -42,15 +67,49 @@ type Sandbox struct {
 type SandboxCreateRequest struct {
 	ImageName string `json:"image_name"`
 	StartCommand string `json:"start_command,omitempty"`
+	// Resources are the limits the agent runs the sandbox with.
+	Resources Resources `json:"resources,omitempty"`
+	// Env holds the sandbox's environment with secrets already resolved,
+	// so it must never be logged.
+	Env map[string]string `json:"env,omitempty"`
+	Mounts []SandboxMount `json:"mounts,omitempty"`
 }
 
 type ContainerCreateRequest struct {
 	ImageName string `json:"image_name"`
 	StartCommand string `json:"start_command,omitempty"`
+	Resources Resources `json:"resources,omitempty"`
+	// Env, Secrets and Mounts are layered over the service's.
+	Env map[string]string `json:"env,omitempty"`
+	Secrets map[string]string `json:"secrets,omitempty"`
+	Mounts []VolumeMount `json:"mounts,omitempty"`
 }
 
 type ServiceCreateRequest struct {
 	Name string `json:"name"`
+	ServiceTemplate
+	Replicas int `json:"replicas,omitempty"`
+}
+
+type ServiceScaleRequest struct {
+	Replicas *int `json:"replicas"`
+	// Remove is the scale down policy: "newest" (the default) or
+	// "most-loaded".
+	Remove string `json:"remove,omitempty"`
+}
+
+// ServiceUpdateRequest changes a service's template; omitted fields are left
+// as they are.
+type ServiceUpdateRequest struct {
+	ImageName *string `json:"image_name,omitempty"`
+	StartCommand *string `json:"start_command,omitempty"`
+	Resources *Resources `json:"resources,omitempty"`
+	// Env, Secrets and Mounts replace the service's whole maps or list
+	// when given.
+	Env *map[string]string `json:"env,omitempty"`
+	Secrets *map[string]string `json:"secrets,omitempty"`
+	Mounts *[]VolumeMount `json:"mounts,omitempty"`
+	Replicas *int `json:"replicas,omitempty"`
 }
 
 type Container struct {
@@ -60,20 +119,123 @@ type Container struct {
 	SandboxID string `json:"sandbox_id"`
 	Host string `json:"host"`
 	ImageName string `json:"image_name"`
-	StartCommand string `json:"start_command",omitempty`
+	StartCommand string `json:"start_command,omitempty"`
+	Resources Resources `json:"resources"`
+	// Env and Secrets are what the container was started with; secrets
+	// appear by name only.
+	Env map[string]string `json:"env,omitempty"`
+	Secrets map[string]string `json:"secrets,omitempty"`
+	Mounts []VolumeMount `json:"mounts,omitempty"`
 	Status string `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
-var serviceHandler = NewServiceHandler()
-var serverHandler = NewServerHandler()
-var serverPort = "8002"
+var serviceHandler *ServiceHandler
+var serverHandler *ServerHandler
+var scheduler *Scheduler
+var sandboxClient SandboxClient
+var reconciler *Reconciler
+var reaper *Reaper
+var warmPool *WarmPool
+var operationHandler *OperationHandler
+var agentMonitor *AgentMonitor
+var secretHandler *SecretHandler
+var volumeHandler *VolumeHandler
 
 func main() {
-	err := godotenv.Load()
-    if err != nil {
-        log.Println("Warning: Error loading .env file")
-    }
+	config, err := LoadConfig("")
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	store, err := NewStore(config.Store.Type, config.Store.Path)
+	if err != nil {
+		log.Fatalf("Error opening store: %v", err)
+	}
+	serverAdapter, err := NewServerAdapter(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverHandler, err = NewServerHandler(store, serverAdapter, time.Duration(config.Agent.ReadyTimeoutSeconds) * time.Second, config.Bootstrap.Token)
+	if err != nil {
+		log.Fatalf("Error loading servers: %v", err)
+	}
+	serviceHandler, err = NewServiceHandler(store)
+	if err != nil {
+		log.Fatalf("Error loading services: %v", err)
+	}
+	operationHandler, err = NewOperationHandler(store)
+	if err != nil {
+		log.Fatalf("Error loading operations: %v", err)
+	}
+	masterKey, err := loadMasterKey(config.Secrets.KeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secretHandler, err = NewSecretHandler(store, masterKey)
+	if err != nil {
+		log.Fatalf("Error loading secrets: %v", err)
+	}
+	volumeHandler, err = NewVolumeHandler(store, config)
+	if err != nil {
+		log.Fatalf("Error loading volumes: %v", err)
+	}
+	scheduler, err = NewScheduler(config.Scheduler)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sandboxClient, err = NewSandboxClient(config.Agent, config.Bootstrap.Token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reconciler = NewReconciler(time.Duration(config.Reconciler.IntervalSeconds) * time.Second)
+	warmPool = NewWarmPool(config.WarmPool)
+	reaper = NewReaper(config.Reaper, config.WarmPool.Size)
+	agentMonitor = NewAgentMonitor(config.Agent)
+
+	// Background loops stop when the server begins shutting down
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go reconciler.Run(background)
+	go reaper.Run(background)
+	go warmPool.Run(background)
+	go agentMonitor.Run(background)
+
+	server := &http.Server{
+		Addr: fmt.Sprintf(":%s", config.Port),
+		Handler: newRouter(config),
+	}
+
+	// Channel to listen for interrupt signals
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		log.Println("Starting server on port", config.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	// Wait for shutdown signal
+	<-sigChan
+	log.Println("Shutdown signal received, shutting down gracefully...")
+	stopBackground()
+
+	// Create a context with timeout for graceful shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+
+	log.Println("Server shutdown complete")
+}
+
+// newRouter serves the control plane API. The handlers reach the package's
+// handlers through their globals, which main sets up first.
+func newRouter(config Config) http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Route("/api", func(r chi.Router) {
@@ -81,7 +243,7 @@ func main() {
 			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 				result, err := serviceHandler.ListServices()
 				if err != nil {
-					returnErrorResponse(w, "Internal Server Error", http.StatusInternalServerError)
+					returnError(w, err)
 					return
 				}
 
@@ -96,11 +258,18 @@ func main() {
 					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
 					return
 				}
-				result, err := serviceHandler.CreateService(data.Name)
+				if data.Name == "" {
+					returnError(w, ValidationError("Service name is required"))
+					return
+				}
+				result, err := serviceHandler.CreateService(data.Name, data.ServiceTemplate, data.Replicas)
 				if err != nil {
-					returnErrorResponse(w, "Internal Server Error", http.StatusInternalServerError)
+					returnError(w, err)
 					return
 				}
+				if result.Replicas > 0 {
+					reconciler.Trigger()
+				}
 
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(result)
@@ -110,18 +279,108 @@ func main() {
 				serviceID := chi.URLParam(r, "serviceID")
 				result, err := serviceHandler.GetService(serviceID)
 				if err != nil {
-					returnErrorResponse(w, "Not found", http.StatusNotFound)
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Patch("/{serviceID}", func(w http.ResponseWriter, r *http.Request) {
+				serviceID := chi.URLParam(r, "serviceID")
+				data := &ServiceUpdateRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				result, err := serviceHandler.UpdateService(serviceID, *data)
+				if err != nil {
+					returnError(w, err)
 					return
 				}
+				reconciler.Trigger()
+
 				w.Header().Set("Content-Type", "application/json")
 				json.NewEncoder(w).Encode(result)
 			})
 
+			r.Post("/{serviceID}/scale", func(w http.ResponseWriter, r *http.Request) {
+				serviceID := chi.URLParam(r, "serviceID")
+				data := &ServiceScaleRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				if data.Replicas == nil {
+					returnError(w, ValidationError("Replicas is required"))
+					return
+				}
+				service, err := serviceHandler.GetService(serviceID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				if err := service.validateScale(*data.Replicas, data.Remove); err != nil {
+					returnError(w, err)
+					return
+				}
+				operation, err := operationHandler.Start("service.scale", serviceID, func(ctx context.Context, run *OperationRun) (any, error) {
+					run.Step(10, "Scaling to %d replicas", *data.Replicas)
+					return serviceHandler.ScaleService(serviceID, *data.Replicas, data.Remove)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+
+			r.Get("/{serviceID}/events", func(w http.ResponseWriter, r *http.Request) {
+				serviceID := chi.URLParam(r, "serviceID")
+				service, err := serviceHandler.GetService(serviceID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				result := service.Events
+				if result == nil {
+					result = []ServiceEvent{}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{serviceID}/deploy", func(w http.ResponseWriter, r *http.Request) {
+				serviceID := chi.URLParam(r, "serviceID")
+				data := &ServiceUpdateRequest{}
+
+				// The body is optional; without one the current template is
+				// rolled out again.
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil && err != io.EOF {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				if _, err := serviceHandler.UpdateService(serviceID, *data); err != nil {
+					returnError(w, err)
+					return
+				}
+				operation, err := operationHandler.Start("service.deploy", serviceID, func(ctx context.Context, run *OperationRun) (any, error) {
+					return serviceHandler.DeployService(ctx, serviceID, run)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+
 			r.Delete("/{serviceID}", func(w http.ResponseWriter, r *http.Request) {
 				serviceID := chi.URLParam(r, "serviceID")
 				err := serviceHandler.DeleteService(serviceID)
 				if err != nil {
-					returnErrorResponse(w, "Not found", http.StatusNotFound)
+					returnError(w, err)
 					return
 				}
 				w.WriteHeader(http.StatusNoContent)
@@ -132,12 +391,12 @@ func main() {
 					serviceID := chi.URLParam(r, "serviceID")
 					service, err := serviceHandler.GetService(serviceID)
 					if err != nil {
-						returnErrorResponse(w, "Not found", http.StatusNotFound)
+						returnError(w, err)
 						return
 					}
 					result, err := service.ListContainers()
 					if err != nil {
-						returnErrorResponse(w, "Internal server error", http.StatusInternalServerError)
+						returnError(w, err)
 						return
 					}
 					w.Header().Set("Content-Type", "application/json")
@@ -146,9 +405,9 @@ func main() {
 
 				r.Post("/", func(w http.ResponseWriter, r *http.Request) {
 					serviceID := chi.URLParam(r, "serviceID")
-					service, err := serviceHandler.GetService(serviceID)
+					_, err := serviceHandler.GetService(serviceID)
 					if err != nil {
-						returnErrorResponse(w, "Not found", http.StatusNotFound)
+						returnError(w, err)
 						return
 					}
 
@@ -159,56 +418,542 @@ func main() {
 						return
 					}
 
-					container, err := service.CreateContainer(data.ImageName, data.StartCommand)
+					if data.ImageName == "" {
+						returnError(w, ValidationError("Image name is required"))
+						return
+					}
+					if err := data.Resources.Validate(); err != nil {
+						returnError(w, err)
+						return
+					}
+					if err := validateEnv(data.Env, data.Secrets); err != nil {
+						returnError(w, err)
+						return
+					}
+					if err := volumeHandler.validateMounts(data.Mounts); err != nil {
+						returnError(w, err)
+						return
+					}
+
+					operation, err := operationHandler.Start("container.create", serviceID, func(ctx context.Context, run *OperationRun) (any, error) {
+						run.Step(10, "Placing container for image '%s'", data.ImageName)
+						return serviceHandler.CreateContainer(serviceID, ServiceTemplate{ImageName: data.ImageName, StartCommand: data.StartCommand, Resources: data.Resources, Env: data.Env, Secrets: data.Secrets, Mounts: data.Mounts})
+					})
 					if err != nil {
-						returnErrorResponse(w, "Internal Server error", http.StatusInternalServerError)
+						returnError(w, err)
 						return
 					}
+					returnOperation(w, operation)
+				})
 
+				r.Get("/{containerID}", func(w http.ResponseWriter, r *http.Request) {
+					serviceID := chi.URLParam(r, "serviceID")
+					containerID := chi.URLParam(r, "containerID")
+					service, err := serviceHandler.GetService(serviceID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					container, err := service.GetContainer(containerID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
 					w.Header().Set("Content-Type", "application/json")
 					json.NewEncoder(w).Encode(container)
 				})
+
+				r.Delete("/{containerID}", func(w http.ResponseWriter, r *http.Request) {
+					serviceID := chi.URLParam(r, "serviceID")
+					containerID := chi.URLParam(r, "containerID")
+					err := serviceHandler.DeleteContainer(serviceID, containerID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					w.WriteHeader(http.StatusNoContent)
+				})
+
+				r.Get("/{containerID}/logs", func(w http.ResponseWriter, r *http.Request) {
+					serviceID := chi.URLParam(r, "serviceID")
+					containerID := chi.URLParam(r, "containerID")
+					service, err := serviceHandler.GetService(serviceID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					logs, err := service.ContainerLogs(containerID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					w.Header().Set("Content-Type", "text/plain")
+					w.Write([]byte(logs))
+				})
+
+				r.Post("/{containerID}/exec", func(w http.ResponseWriter, r *http.Request) {
+					serviceID := chi.URLParam(r, "serviceID")
+					containerID := chi.URLParam(r, "containerID")
+					service, err := serviceHandler.GetService(serviceID)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+
+					data := &SandboxExecRequest{}
+
+					if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+						returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+						return
+					}
+					result, err := service.ExecContainer(containerID, data.Command)
+					if err != nil {
+						returnError(w, err)
+						return
+					}
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(result)
+				})
+
+				for _, action := range []string{"stop", "start", "restart"} {
+					r.Post(fmt.Sprintf("/{containerID}/%s", action), func(w http.ResponseWriter, r *http.Request) {
+						serviceID := chi.URLParam(r, "serviceID")
+						containerID := chi.URLParam(r, "containerID")
+						container, err := serviceHandler.ContainerAction(serviceID, containerID, action)
+						if err != nil {
+							returnError(w, err)
+							return
+						}
+						w.Header().Set("Content-Type", "application/json")
+						json.NewEncoder(w).Encode(container)
+					})
+				}
 			})
 		})
-	})
 
-	server := &http.Server{
-		Addr: fmt.Sprintf(":%s", serverPort),
-		Handler: r,
-	}
+		r.Route("/servers", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				result, err := serverHandler.ListServers()
+				if err != nil {
+					returnError(w, err)
+					return
+				}
 
-	// Channel to listen for interrupt signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
 
-	go func() {
-		log.Println("Starting server on port", serverPort)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
-		}
-	}()
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				data := &ServerCreateRequest{}
 
-	// Wait for shutdown signal
-	<-sigChan
-	log.Println("Shutdown signal received, shutting down gracefully...")
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				if data.Name == "" {
+					returnError(w, ValidationError("Server name is required"))
+					return
+				}
+				if err := validateServerName(data.Name); err != nil {
+					returnError(w, err)
+					return
+				}
+				operation, err := operationHandler.Start("server.create", data.Name, func(ctx context.Context, run *OperationRun) (any, error) {
+					run.Step(10, "Provisioning server '%s'", data.Name)
+					return serverHandler.CreateServer(data.Name, data.ServerType, data.Location)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
 
-	// Create a context with timeout for graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+			r.Get("/pool", func(w http.ResponseWriter, r *http.Request) {
+				result, err := warmPool.Status()
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
-	}
+			r.Get("/reaper", func(w http.ResponseWriter, r *http.Request) {
+				result, err := reaper.Plan(time.Now())
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
 
-	log.Println("Server shutdown complete")
+			// New servers call this from cloud-init once they finished
+			// booting, with their own bootstrap token
+			r.Post("/phone-home/{name}", func(w http.ResponseWriter, r *http.Request) {
+				token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if err := r.ParseForm(); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				hostKeys := []string{}
+				for _, field := range []string{"pub_key_ed25519", "pub_key_ecdsa", "pub_key_rsa"} {
+					if key := strings.TrimSpace(r.PostForm.Get(field)); key != "" {
+						hostKeys = append(hostKeys, key)
+					}
+				}
+				result, err := serverHandler.PhoneHome(chi.URLParam(r, "name"), token, hostKeys)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Get("/{serverID}", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				result, err := serverHandler.GetServer(serverID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Delete("/{serverID}", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				if _, err := serverHandler.GetServer(serverID); err != nil {
+					returnError(w, err)
+					return
+				}
+				drain := r.URL.Query().Get("drain") == "true"
+				operation, err := operationHandler.Start("server.delete", serverID, func(ctx context.Context, run *OperationRun) (any, error) {
+					if drain {
+						if _, err := serverHandler.DrainServer(ctx, serverID, run); err != nil {
+							return nil, err
+						}
+						if err := ctx.Err(); err != nil {
+							return nil, err
+						}
+					}
+					run.Step(90, "Deprovisioning server '%s'", serverID)
+					return nil, serverHandler.DeleteServer(serverID)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+
+			r.Post("/{serverID}/cordon", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				result, err := serverHandler.SetCordoned(serverID, true)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{serverID}/uncordon", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				result, err := serverHandler.SetCordoned(serverID, false)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{serverID}/drain", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				if _, err := serverHandler.GetServer(serverID); err != nil {
+					returnError(w, err)
+					return
+				}
+				operation, err := operationHandler.Start("server.drain", serverID, func(ctx context.Context, run *OperationRun) (any, error) {
+					return serverHandler.DrainServer(ctx, serverID, run)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+
+			r.Get("/{serverID}/containers", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				_, err := serverHandler.GetServer(serverID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				result, err := serviceHandler.ListServerContainers(serverID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+		})
+
+		// Agents authenticate with their server's bootstrap token when they
+		// first register and with their agent token after that
+		r.Route("/agents", func(r chi.Router) {
+			r.Post("/register", func(w http.ResponseWriter, r *http.Request) {
+				token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				data := &AgentRegisterRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				server, err := serverHandler.RegisterAgent(*data, token)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				result := AgentRegisterResponse{ServerID: server.ID, HeartbeatIntervalSeconds: config.Agent.HeartbeatIntervalSeconds, AgentToken: agentToken(config.Bootstrap.Token, server.IP)}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{serverID}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+				serverID := chi.URLParam(r, "serverID")
+				if err := serverHandler.AuthorizeAgent(serverID, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+					returnError(w, err)
+					return
+				}
+				data := &AgentHeartbeatRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				if _, err := serverHandler.Heartbeat(serverID, *data); err != nil {
+					returnError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+
+		r.Route("/secrets", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(secretHandler.ListSecrets())
+			})
+
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				data := &SecretCreateRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				result, err := secretHandler.CreateSecret(data.Name, data.Value)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Get("/{name}", func(w http.ResponseWriter, r *http.Request) {
+				result, err := secretHandler.GetSecret(chi.URLParam(r, "name"))
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Put("/{name}", func(w http.ResponseWriter, r *http.Request) {
+				data := &SecretUpdateRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				result, err := secretHandler.UpdateSecret(chi.URLParam(r, "name"), data.Value)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Delete("/{name}", func(w http.ResponseWriter, r *http.Request) {
+				if err := secretHandler.DeleteSecret(chi.URLParam(r, "name")); err != nil {
+					returnError(w, err)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+
+		r.Route("/volumes", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(volumeHandler.ListVolumes())
+			})
+
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				data := &VolumeCreateRequest{}
+
+				if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+					returnErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+					return
+				}
+				result, err := volumeHandler.CreateVolume(*data)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Get("/{volumeID}", func(w http.ResponseWriter, r *http.Request) {
+				result, err := volumeHandler.GetVolume(chi.URLParam(r, "volumeID"))
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{volumeID}/detach", func(w http.ResponseWriter, r *http.Request) {
+				volumeID := chi.URLParam(r, "volumeID")
+				if _, err := volumeHandler.GetVolume(volumeID); err != nil {
+					returnError(w, err)
+					return
+				}
+
+				operation, err := operationHandler.Start("volume.detach", volumeID, func(ctx context.Context, run *OperationRun) (any, error) {
+					return volumeHandler.DetachVolume(volumeID)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+
+			r.Delete("/{volumeID}", func(w http.ResponseWriter, r *http.Request) {
+				volumeID := chi.URLParam(r, "volumeID")
+				if _, err := volumeHandler.GetVolume(volumeID); err != nil {
+					returnError(w, err)
+					return
+				}
+
+				operation, err := operationHandler.Start("volume.delete", volumeID, func(ctx context.Context, run *OperationRun) (any, error) {
+					return nil, volumeHandler.DeleteVolume(volumeID)
+				})
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, operation)
+			})
+		})
+
+		r.Route("/operations", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				result, err := operationHandler.ListOperations()
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Get("/{operationID}", func(w http.ResponseWriter, r *http.Request) {
+				operationID := chi.URLParam(r, "operationID")
+				result, err := operationHandler.GetOperation(operationID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(result)
+			})
+
+			r.Post("/{operationID}/cancel", func(w http.ResponseWriter, r *http.Request) {
+				operationID := chi.URLParam(r, "operationID")
+				result, err := operationHandler.CancelOperation(operationID)
+				if err != nil {
+					returnError(w, err)
+					return
+				}
+				returnOperation(w, result)
+			})
+		})
+	})
+
+	return r
+}
+
+// returnOperation answers 202 Accepted with an operation the client can poll
+// at its Location.
+func returnOperation(w http.ResponseWriter, operation Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/operations/%s", operation.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(operation)
+}
+
+// returnError answers with the status code and error code for err's kind.
+// Unclassified errors are logged and reported without their details.
+func returnError(w http.ResponseWriter, err error) {
+	kind := KindOf(err)
+	message := err.Error()
+	if kind == ErrInternal {
+		log.Printf("Internal error: %v", err)
+		message = "Internal server error"
+	}
+	writeErrorResponse(w, message, kind, kind.StatusCode())
 }
 
 func returnErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	kind := ErrInternal
+	switch statusCode {
+	case http.StatusBadRequest:
+		kind = ErrValidation
+	case http.StatusNotFound:
+		kind = ErrNotFound
+	case http.StatusConflict:
+		kind = ErrConflict
+	}
+	writeErrorResponse(w, message, kind, statusCode)
+}
+
+func writeErrorResponse(w http.ResponseWriter, message string, kind ErrorKind, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	errorResponse := map[string]string{
 		"message": message,
+		"code": string(kind),
 	}
 	json.NewEncoder(w).Encode(errorResponse)
 }
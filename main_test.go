@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCluster points the package's handlers at an in-memory store, a single
+// "localhost" server and a FakeSandboxClient, and returns the fake so tests
+// can look at the sandboxes containers got.
+func newTestCluster(t *testing.T) *FakeSandboxClient {
+	t.Helper()
+	config := defaultConfig()
+	config.Store.Type = "memory"
+	config.Agent.Client = "fake"
+
+	store := NewMemoryStore()
+	serverAdapter, err := NewLocalServerAdapter(config.Local, config.Bootstrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverHandler, err = NewServerHandler(store, serverAdapter, time.Second, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if serviceHandler, err = NewServiceHandler(store); err != nil {
+		t.Fatal(err)
+	}
+	if operationHandler, err = NewOperationHandler(store); err != nil {
+		t.Fatal(err)
+	}
+	if secretHandler, err = NewSecretHandler(store, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if volumeHandler, err = NewVolumeHandler(store, config); err != nil {
+		t.Fatal(err)
+	}
+	if scheduler, err = NewScheduler(config.Scheduler); err != nil {
+		t.Fatal(err)
+	}
+	fake := NewFakeSandboxClient()
+	sandboxClient = fake
+	reconciler = NewReconciler(time.Hour)
+	warmPool = nil
+	return fake
+}
+
+// sandboxCount counts the sandboxes the fake holds across all servers.
+func (f *FakeSandboxClient) sandboxCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, sandboxes := range f.sandboxes {
+		count += len(sandboxes)
+	}
+	return count
+}
+
+// apiRequest sends body as JSON to the control plane API and decodes the
+// response into result, if given.
+func apiRequest(t *testing.T, handler http.Handler, method string, path string, body any, result any) int {
+	t.Helper()
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewReader(encoded)))
+	if result != nil && recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+// waitForOperation polls an operation until it has finished.
+func waitForOperation(t *testing.T, handler http.Handler, operation Operation) Operation {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for operation.Status == OperationPending || operation.Status == OperationRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("operation '%s' still %s", operation.ID, operation.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if code := apiRequest(t, handler, http.MethodGet, "/api/operations/"+operation.ID, nil, &operation); code != http.StatusOK {
+			t.Fatalf("GET operation '%s': %d", operation.ID, code)
+		}
+	}
+	return operation
+}
+
+// createTestContainer creates a service and one container in it through the
+// API.
+func createTestContainer(t *testing.T, handler http.Handler) (Service, Container) {
+	t.Helper()
+	var service Service
+	if code := apiRequest(t, handler, http.MethodPost, "/api/services", ServiceCreateRequest{Name: "web"}, &service); code != http.StatusOK {
+		t.Fatalf("creating service: %d", code)
+	}
+	var operation Operation
+	if code := apiRequest(t, handler, http.MethodPost, "/api/services/"+service.ID+"/containers", ContainerCreateRequest{ImageName: "nginx"}, &operation); code != http.StatusAccepted {
+		t.Fatalf("creating container: %d", code)
+	}
+	operation = waitForOperation(t, handler, operation)
+	if operation.Status != OperationSucceeded {
+		t.Fatalf("creating container failed: %s", operation.Error)
+	}
+	var container Container
+	if err := json.Unmarshal(operation.Result, &container); err != nil {
+		t.Fatal(err)
+	}
+	return service, container
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	fake := newTestCluster(t)
+	handler := newRouter(defaultConfig())
+	service, container := createTestContainer(t, handler)
+	path := "/api/services/" + service.ID + "/containers/" + container.ID
+
+	if code := apiRequest(t, handler, http.MethodGet, path, nil, &container); code != http.StatusOK || container.Status != "running" {
+		t.Fatalf("GET container: %d, status %q", code, container.Status)
+	}
+	if code := apiRequest(t, handler, http.MethodPost, path+"/stop", nil, &container); code != http.StatusOK || container.Status != "stopped" {
+		t.Fatalf("stopping container: %d, status %q", code, container.Status)
+	}
+	if code := apiRequest(t, handler, http.MethodDelete, path, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("DELETE container: %d", code)
+	}
+	if count := fake.sandboxCount(); count != 0 {
+		t.Errorf("agents still have %d sandboxes", count)
+	}
+
+	var response map[string]string
+	if code := apiRequest(t, handler, http.MethodGet, path, nil, &response); code != http.StatusNotFound || response["code"] != string(ErrNotFound) {
+		t.Errorf("GET deleted container: %d %v", code, response)
+	}
+}
+
+func TestContainerWithVanishedSandbox(t *testing.T) {
+	fake := newTestCluster(t)
+	handler := newRouter(defaultConfig())
+	service, container := createTestContainer(t, handler)
+	path := "/api/services/" + service.ID + "/containers/" + container.ID
+
+	server, err := serverHandler.GetServer(container.ServerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.DeleteSandbox(server.IP, container.SandboxID); err != nil {
+		t.Fatal(err)
+	}
+
+	var response map[string]string
+	if code := apiRequest(t, handler, http.MethodGet, path, nil, &response); code != http.StatusNotFound || response["message"] != errSandboxNotFound.Error() {
+		t.Errorf("GET container without a sandbox: %d %v", code, response)
+	}
+	// A sandbox that is already gone counts as deleted
+	if code := apiRequest(t, handler, http.MethodDelete, path, nil, nil); code != http.StatusNoContent {
+		t.Errorf("DELETE container without a sandbox: %d", code)
+	}
+}
+
+// tokenRecordingAdapter remembers the bootstrap token each server was
+// created with.
+type tokenRecordingAdapter struct {
+	ServerAdapter
+	tokens map[string]string
+}
+
+func (t *tokenRecordingAdapter) CreateServer(name string, serverType string, location string, bootstrapToken string) (RemoteServer, error) {
+	t.tokens[name] = bootstrapToken
+	return t.ServerAdapter.CreateServer(name, serverType, location, bootstrapToken)
+}
+
+// recordBootstrapTokens has the test cluster's servers remember their
+// bootstrap tokens.
+func recordBootstrapTokens() map[string]string {
+	adapter := &tokenRecordingAdapter{ServerAdapter: serverHandler.ServerAdapter, tokens: make(map[string]string)}
+	serverHandler.ServerAdapter = adapter
+	return adapter.tokens
+}
+
+func TestPhoneHomeNeedsTheServersToken(t *testing.T) {
+	newTestCluster(t)
+	tokens := recordBootstrapTokens()
+	for _, name := range []string{"jcs-a", "jcs-b"} {
+		if _, err := serverHandler.CreateServer(name, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := newRouter(defaultConfig())
+	form := url.Values{"pub_key_ed25519": {"ssh-ed25519 AAAA"}}.Encode()
+
+	phoneHome := func(path string, authorization string) int {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	for description, authorization := range map[string]string{
+		"the shared token":        "Bearer " + serverHandler.token,
+		"another server's token": "Bearer " + tokens["jcs-b"],
+		"a wrong token":           "Bearer wrong",
+	} {
+		if code := phoneHome("/api/servers/phone-home/jcs-a", authorization); code != http.StatusUnauthorized {
+			t.Errorf("%s: %d, want 401", description, code)
+		}
+	}
+	if code := phoneHome("/api/servers/phone-home/jcs-a?token="+tokens["jcs-a"], ""); code != http.StatusUnauthorized {
+		t.Errorf("token in the query: %d, want 401", code)
+	}
+	if code := phoneHome("/api/servers/phone-home/jcs-a", "Bearer "+tokens["jcs-a"]); code != http.StatusOK {
+		t.Fatalf("the server's own token: %d, want 200", code)
+	}
+	if code := phoneHome("/api/servers/phone-home/jcs-a", "Bearer "+tokens["jcs-a"]); code != http.StatusUnauthorized {
+		t.Errorf("the server's token a second time: %d, want 401", code)
+	}
+
+	servers, err := serverHandler.ListServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		if want := map[string]int{"jcs-a": 1}[server.Name]; len(server.SSHHostKeys) != want {
+			t.Errorf("server '%s' has %d host keys, want %d", server.Name, len(server.SSHHostKeys), want)
+		}
+	}
+}
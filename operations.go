@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OperationPending   = "pending"
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+	OperationCancelled = "cancelled"
+)
+
+const (
+	// Finished operations are pruned once they are older than
+	// operationRetention, or beyond the newest maxFinishedOperations.
+	operationRetention    = 24 * time.Hour
+	maxFinishedOperations = 500
+	// operationStepSaveInterval is how often a running operation's steps
+	// are persisted; status changes are always persisted right away.
+	operationStepSaveInterval = 2 * time.Second
+)
+
+// Operation tracks a long-running action started through the API, such as
+// creating a server or draining one.
+type Operation struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Target    string          `json:"target"`
+	Status    string          `json:"status"`
+	Progress  int             `json:"progress"`
+	Steps     []OperationStep `json:"steps"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode ErrorKind       `json:"error_code,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type OperationStep struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+func (o Operation) Finished() bool {
+	switch o.Status {
+	case OperationSucceeded, OperationFailed, OperationCancelled:
+		return true
+	}
+	return false
+}
+
+func (o Operation) clone() Operation {
+	o.Steps = append([]OperationStep(nil), o.Steps...)
+	return o
+}
+
+// OperationRun is handed to a running operation so it can report progress.
+type OperationRun struct {
+	handler *OperationHandler
+	ID      string
+}
+
+// Step appends a message to the operation's step log and moves its progress
+// (0-100) forward. Steps are visible through the API right away but only
+// persisted every operationStepSaveInterval, since every save rewrites the
+// store.
+func (r *OperationRun) Step(progress int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	r.handler.update(r.ID, false, func(operation *Operation) {
+		operation.Progress = progress
+		operation.Steps = append(operation.Steps, OperationStep{Time: time.Now().UTC(), Message: message})
+	})
+}
+
+type OperationFunc func(ctx context.Context, run *OperationRun) (any, error)
+
+type OperationHandler struct {
+	mu         sync.RWMutex
+	Operations map[string]Operation
+	cancels    map[string]context.CancelFunc
+	// savedAt is when each running operation was last persisted.
+	savedAt map[string]time.Time
+	store   Store
+}
+
+// NewOperationHandler loads past operations from the store. Operations that
+// were still running when the control plane stopped can't be resumed, so they
+// are marked as failed.
+func NewOperationHandler(store Store) (*OperationHandler, error) {
+	operations := make(map[string]Operation)
+	storedOperations, err := store.ListOperations()
+	if err != nil {
+		return nil, err
+	}
+	for _, operation := range storedOperations {
+		if !operation.Finished() {
+			operation.Status = OperationFailed
+			operation.Error = "Interrupted by a control plane restart"
+			operation.ErrorCode = ErrInternal
+			operation.UpdatedAt = time.Now().UTC()
+			if err := store.SaveOperation(operation); err != nil {
+				return nil, err
+			}
+		}
+		operations[operation.ID] = operation
+	}
+
+	handler := &OperationHandler{
+		Operations: operations,
+		cancels:    make(map[string]context.CancelFunc),
+		savedAt:    make(map[string]time.Time),
+		store:      store,
+	}
+	handler.pruneLocked(time.Now().UTC())
+	return handler, nil
+}
+
+// Start records a new operation and runs fn in the background. fn's result
+// becomes the operation's result.
+func (h *OperationHandler) Start(operationType string, target string, fn OperationFunc) (Operation, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return Operation{}, err
+	}
+	now := time.Now().UTC()
+	operation := Operation{ID: id, Type: operationType, Target: target, Status: OperationPending, Steps: []OperationStep{}, CreatedAt: now, UpdatedAt: now}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.pruneLocked(now)
+	if err := h.store.SaveOperation(operation); err != nil {
+		h.mu.Unlock()
+		cancel()
+		return Operation{}, err
+	}
+	h.Operations[id] = operation
+	h.cancels[id] = cancel
+	h.savedAt[id] = now
+	h.mu.Unlock()
+
+	go h.run(ctx, operation.ID, fn)
+
+	return operation, nil
+}
+
+func (h *OperationHandler) run(ctx context.Context, ID string, fn OperationFunc) {
+	defer func() {
+		h.mu.Lock()
+		if cancel, ok := h.cancels[ID]; ok {
+			cancel()
+			delete(h.cancels, ID)
+		}
+		delete(h.savedAt, ID)
+		h.mu.Unlock()
+	}()
+
+	h.update(ID, true, func(operation *Operation) {
+		operation.Status = OperationRunning
+	})
+
+	result, err := fn(ctx, &OperationRun{handler: h, ID: ID})
+
+	h.update(ID, true, func(operation *Operation) {
+		switch {
+		case errors.Is(err, context.Canceled):
+			operation.Status = OperationCancelled
+			operation.Steps = append(operation.Steps, OperationStep{Time: time.Now().UTC(), Message: "Cancelled"})
+		case err != nil:
+			operation.Status = OperationFailed
+			operation.Error = err.Error()
+			operation.ErrorCode = KindOf(err)
+		default:
+			operation.Status = OperationSucceeded
+			operation.Progress = 100
+			if result != nil {
+				encoded, err := json.Marshal(result)
+				if err != nil {
+					operation.Status = OperationFailed
+					operation.Error = fmt.Sprintf("Error encoding result: %v", err)
+					operation.ErrorCode = ErrInternal
+					return
+				}
+				operation.Result = encoded
+			}
+		}
+	})
+}
+
+// update changes an operation. It is persisted when persist is set, or when
+// it hasn't been for operationStepSaveInterval.
+func (h *OperationHandler) update(ID string, persist bool, change func(operation *Operation)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	operation, ok := h.Operations[ID]
+	if !ok {
+		return
+	}
+	operation = operation.clone()
+	change(&operation)
+	operation.UpdatedAt = time.Now().UTC()
+	h.Operations[ID] = operation
+	if !persist && operation.UpdatedAt.Sub(h.savedAt[ID]) < operationStepSaveInterval {
+		return
+	}
+	if err := h.store.SaveOperation(operation); err != nil {
+		log.Printf("Error saving operation '%s': %v", ID, err)
+		return
+	}
+	h.savedAt[ID] = operation.UpdatedAt
+}
+
+// pruneLocked forgets finished operations older than operationRetention and
+// all but the newest maxFinishedOperations. Callers must hold h.mu.
+func (h *OperationHandler) pruneLocked(now time.Time) {
+	finished := []Operation{}
+	for _, operation := range h.Operations {
+		if operation.Finished() {
+			finished = append(finished, operation)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].UpdatedAt.After(finished[j].UpdatedAt)
+	})
+
+	IDs := []string{}
+	for i, operation := range finished {
+		if i >= maxFinishedOperations || now.Sub(operation.UpdatedAt) > operationRetention {
+			IDs = append(IDs, operation.ID)
+		}
+	}
+	if len(IDs) == 0 {
+		return
+	}
+	if err := h.store.DeleteOperations(IDs); err != nil {
+		log.Printf("Error pruning %d finished operations: %v", len(IDs), err)
+		return
+	}
+	for _, ID := range IDs {
+		delete(h.Operations, ID)
+	}
+}
+
+func (h *OperationHandler) GetOperation(ID string) (Operation, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	operation, ok := h.Operations[ID]
+	if !ok {
+		return operation, NotFoundError("Operation not found with ID '%s'", ID)
+	}
+	return operation.clone(), nil
+}
+
+// ListOperations returns all operations, newest first.
+func (h *OperationHandler) ListOperations() ([]Operation, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	operations := make([]Operation, 0, len(h.Operations))
+	for _, operation := range h.Operations {
+		operations = append(operations, operation.clone())
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].CreatedAt.After(operations[j].CreatedAt)
+	})
+
+	return operations, nil
+}
+
+// CancelOperation asks a running operation to stop. It takes effect at the
+// operation's next step, so work already sent to a provider may still finish.
+func (h *OperationHandler) CancelOperation(ID string) (Operation, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	operation, ok := h.Operations[ID]
+	if !ok {
+		return operation, NotFoundError("Operation not found with ID '%s'", ID)
+	}
+	if operation.Finished() {
+		return operation, ConflictError("Operation '%s' has already %s", ID, operation.Status)
+	}
+	if cancel, ok := h.cancels[ID]; ok {
+		cancel()
+	}
+	return operation.clone(), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts how often operations are saved.
+type countingStore struct {
+	*MemoryStore
+	mu    sync.Mutex
+	saves int
+}
+
+func (c *countingStore) SaveOperation(operation Operation) error {
+	c.mu.Lock()
+	c.saves++
+	c.mu.Unlock()
+	return c.MemoryStore.SaveOperation(operation)
+}
+
+func TestOperationStepsAreSavedInBatches(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	handler, err := NewOperationHandler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	operation, err := handler.Start("test", "", func(ctx context.Context, run *OperationRun) (any, error) {
+		for i := 0; i < 100; i++ {
+			run.Step(i, "Step %d", i)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !operation.Finished() {
+		time.Sleep(10 * time.Millisecond)
+		if operation, err = handler.GetOperation(operation.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pending, running and succeeded are saved; the steps in between aren't
+	store.mu.Lock()
+	saves := store.saves
+	store.mu.Unlock()
+	if saves > 4 {
+		t.Errorf("operation saved %d times for 100 steps", saves)
+	}
+	stored, err := store.ListOperations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || len(stored[0].Steps) != 100 || stored[0].Status != OperationSucceeded {
+		t.Errorf("stored operations = %+v, want the finished operation with all its steps", stored)
+	}
+}
+
+func TestFinishedOperationsArePruned(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now().UTC()
+	store.SaveOperation(Operation{ID: "old", Status: OperationSucceeded, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)})
+	store.SaveOperation(Operation{ID: "running", Status: OperationRunning, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)})
+	for i := 0; i < maxFinishedOperations+10; i++ {
+		at := now.Add(-time.Duration(i) * time.Second)
+		store.SaveOperation(Operation{ID: fmt.Sprintf("op-%d", i), Status: OperationFailed, CreatedAt: at, UpdatedAt: at})
+	}
+
+	handler, err := NewOperationHandler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.GetOperation("old"); !IsNotFound(err) {
+		t.Errorf("operation finished two days ago wasn't pruned: %v", err)
+	}
+	// Interrupted by the restart, so it's finished now and recent
+	if _, err := handler.GetOperation("running"); err != nil {
+		t.Errorf("interrupted operation was pruned: %v", err)
+	}
+	operations, err := handler.ListOperations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(operations) != maxFinishedOperations {
+		t.Errorf("%d operations kept, want %d", len(operations), maxFinishedOperations)
+	}
+	stored, err := store.ListOperations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(operations) {
+		t.Errorf("store kept %d operations, handler %d", len(stored), len(operations))
+	}
+}
+
+func TestScaleStartsAnOperation(t *testing.T) {
+	fake := newTestCluster(t)
+	handler := newRouter(defaultConfig())
+	var service Service
+	if code := apiRequest(t, handler, http.MethodPost, "/api/services", ServiceCreateRequest{Name: "web", ServiceTemplate: ServiceTemplate{ImageName: "nginx"}}, &service); code != http.StatusOK {
+		t.Fatalf("creating service: %d", code)
+	}
+
+	replicas := 3
+	var operation Operation
+	if code := apiRequest(t, handler, http.MethodPost, "/api/services/"+service.ID+"/scale", ServiceScaleRequest{Replicas: &replicas}, &operation); code != http.StatusAccepted {
+		t.Fatalf("scaling: %d", code)
+	}
+	if operation = waitForOperation(t, handler, operation); operation.Status != OperationSucceeded {
+		t.Fatalf("scaling failed: %s", operation.Error)
+	}
+	if count := fake.sandboxCount(); count != replicas {
+		t.Errorf("agents have %d sandboxes, want %d", count, replicas)
+	}
+
+	// Bad requests are rejected before any operation starts
+	replicas = -1
+	if code := apiRequest(t, handler, http.MethodPost, "/api/services/"+service.ID+"/scale", ServiceScaleRequest{Replicas: &replicas}, nil); code != http.StatusBadRequest {
+		t.Errorf("scaling to -1: %d, want 400", code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reaper deprovisions servers that have had no containers for longer than
+// the grace period, always leaving at least MinServers behind. Only servers
+// jcs created itself are ever candidates.
+type Reaper struct {
+	mu        sync.Mutex
+	config    ReaperConfig
+	idleSince map[string]time.Time
+	// warmPoolSize idle servers are left for the warm pool.
+	warmPoolSize int
+}
+
+// ReapCandidate is an idle server and what the reaper would do with it.
+type ReapCandidate struct {
+	Server    Server    `json:"server"`
+	IdleSince time.Time `json:"idle_since"`
+	ReapAt    time.Time `json:"reap_at"`
+	Reap      bool      `json:"reap"`
+	Reason    string    `json:"reason"`
+}
+
+func NewReaper(config ReaperConfig, warmPoolSize int) *Reaper {
+	return &Reaper{
+		config:       config,
+		idleSince:    make(map[string]time.Time),
+		warmPoolSize: warmPoolSize,
+	}
+}
+
+func (r *Reaper) Run(ctx context.Context) {
+	if !r.config.Enabled {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(r.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.reap()
+	}
+}
+
+func (r *Reaper) reap() {
+	plan, err := r.plan(time.Now(), true)
+	if err != nil {
+		log.Printf("Reaper: %v", err)
+		return
+	}
+	for _, candidate := range plan {
+		if !candidate.Reap {
+			continue
+		}
+		if r.config.DryRun {
+			log.Printf("Reaper: would deprovision server '%s', idle since %s", candidate.Server.ID, candidate.IdleSince.Format(time.RFC3339))
+			continue
+		}
+		log.Printf("Reaper: deprovisioning server '%s', idle since %s", candidate.Server.ID, candidate.IdleSince.Format(time.RFC3339))
+		if err := serverHandler.DeleteServer(candidate.Server.ID); err != nil {
+			log.Printf("Reaper: deprovisioning server '%s' failed: %v", candidate.Server.ID, err)
+			continue
+		}
+		r.mu.Lock()
+		delete(r.idleSince, candidate.Server.ID)
+		r.mu.Unlock()
+	}
+}
+
+// Plan decides which idle servers should be deprovisioned as of now, longest
+// idle first, without deprovisioning anything or starting idle timers, so
+// looking at it changes nothing. A server the reaper hasn't yet seen idle is
+// reported as idle since now.
+func (r *Reaper) Plan(now time.Time) ([]ReapCandidate, error) {
+	return r.plan(now, false)
+}
+
+// plan is Plan; with record it also starts the idle timers of servers that
+// have become idle and drops those of servers that are busy or gone. Only
+// the reaper's own ticks record.
+func (r *Reaper) plan(now time.Time, record bool) ([]ReapCandidate, error) {
+	loads, err := scheduler.Loads()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]bool, len(loads))
+	candidates := []ReapCandidate{}
+	for _, load := range loads {
+		seen[load.Server.ID] = true
+		if !load.Server.Owned || load.Containers > 0 || load.Server.Status == "deleting" || load.Server.Status == "provisioning" {
+			if record {
+				delete(r.idleSince, load.Server.ID)
+			}
+			continue
+		}
+		idleSince, ok := r.idleSince[load.Server.ID]
+		if !ok {
+			idleSince = now
+			if record {
+				r.idleSince[load.Server.ID] = now
+			}
+		}
+		candidates = append(candidates, ReapCandidate{Server: load.Server, IdleSince: idleSince})
+	}
+	if record {
+		for serverID := range r.idleSince {
+			if !seen[serverID] {
+				delete(r.idleSince, serverID)
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].IdleSince.Equal(candidates[j].IdleSince) {
+			return candidates[i].Server.ID < candidates[j].Server.ID
+		}
+		return candidates[i].IdleSince.Before(candidates[j].IdleSince)
+	})
+
+	grace := time.Duration(r.config.GracePeriodSeconds) * time.Second
+	remaining := len(loads)
+	idle := 0
+	for _, candidate := range candidates {
+		if candidate.Server.Schedulable() {
+			idle++
+		}
+	}
+	for i := range candidates {
+		candidate := &candidates[i]
+		candidate.ReapAt = candidate.IdleSince.Add(grace)
+		switch {
+		case now.Before(candidate.ReapAt):
+			candidate.Reason = "idle for less than the grace period"
+		case remaining <= r.config.MinServers:
+			candidate.Reason = "needed to keep the minimum pool size"
+		case candidate.Server.Schedulable() && idle <= r.warmPoolSize:
+			candidate.Reason = "kept warm for fast placement"
+		default:
+			candidate.Reap = true
+			candidate.Reason = "idle for longer than the grace period"
+			remaining--
+			if candidate.Server.Schedulable() {
+				idle--
+			}
+		}
+	}
+
+	return candidates, nil
+}
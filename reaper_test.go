@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReaperOnlyReapsOwnedServers(t *testing.T) {
+	newTestCluster(t)
+	owned, err := serverHandler.CreateServer("jcs-idle", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReaper(ReaperConfig{Enabled: true, IntervalSeconds: 60, GracePeriodSeconds: 60, MinServers: 0}, 0)
+	start := time.Now()
+	if _, err := r.plan(start, true); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.Plan(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hand-started localhost server wasn't created by jcs
+	if len(plan) != 1 || plan[0].Server.ID != owned.ID || !plan[0].Reap {
+		t.Fatalf("plan = %+v, want only server '%s' reaped", plan, owned.ID)
+	}
+}
+
+func TestReaperPlanStartsNoIdleTimers(t *testing.T) {
+	newTestCluster(t)
+	if _, err := serverHandler.CreateServer("jcs-idle", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReaper(ReaperConfig{Enabled: true, IntervalSeconds: 60, GracePeriodSeconds: 60, MinServers: 0}, 0)
+	start := time.Now()
+	if _, err := r.Plan(start); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.Plan(start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the reaper's ticks count idle time, not someone looking at the plan
+	if len(plan) != 1 || plan[0].Reap || !plan[0].IdleSince.Equal(start.Add(time.Hour)) {
+		t.Fatalf("plan = %+v, want the server idle only since the second look", plan)
+	}
+}
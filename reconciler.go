@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// Reconciler periodically compares every managed service's desired replicas
+// with the sandboxes its agents report, and creates, restarts or removes
+// containers until they match.
+type Reconciler struct {
+	interval time.Duration
+	wake     chan struct{}
+}
+
+func NewReconciler(interval time.Duration) *Reconciler {
+	return &Reconciler{
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Trigger asks for a reconciliation pass as soon as possible, e.g. after a
+// service's template changed.
+func (r *Reconciler) Trigger() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		r.reconcileAll()
+	}
+}
+
+func (r *Reconciler) reconcileAll() {
+	services, err := serviceHandler.ListServices()
+	if err != nil {
+		log.Printf("Reconciler: error listing services: %v", err)
+		return
+	}
+	for _, service := range services {
+		if err := serviceHandler.ReconcileService(service.ID); err != nil && !IsNotFound(err) {
+			log.Printf("Reconciler: service '%s': %v", service.ID, err)
+		}
+	}
+}
+
+// sandboxDied reports whether a sandbox status means its process is gone
+// without anyone asking it to stop.
+func sandboxDied(status string) bool {
+	switch status {
+	case "exited", "failed", "dead":
+		return true
+	}
+	return false
+}
+
+// reconcile must be called with the service's lock held. Unmanaged services
+// only get their lost containers rescheduled.
+func (s *Service) reconcile() error {
+	for _, container := range s.containersByAge() {
+		if container.Status == containerLost {
+			if _, err := s.replaceLostContainer(container.ID); err != nil {
+				log.Printf("Reconciler: rescheduling lost container '%s' failed: %v", container.ID, err)
+			}
+		}
+	}
+	if !s.Managed() {
+		return nil
+	}
+
+	for _, container := range s.containersByAge() {
+		if container.Status == containerLost {
+			continue
+		}
+		server, err := serverHandler.GetServer(container.ServerID)
+		if IsNotFound(err) {
+			log.Printf("Reconciler: container '%s' of service '%s' lost its server, replacing it", container.ID, s.ID)
+			if err := s.forgetContainer(container.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sandbox, err := sandboxClient.GetSandbox(server.IP, container.SandboxID)
+		switch {
+		case IsNotFound(err):
+			log.Printf("Reconciler: sandbox of container '%s' in service '%s' is gone, replacing it", container.ID, s.ID)
+			if err := s.forgetContainer(container.ID); err != nil {
+				return err
+			}
+		case err != nil:
+			// The agent may be briefly unreachable; leave the container be
+			// and look again on the next pass.
+			log.Printf("Reconciler: could not observe container '%s' in service '%s': %v", container.ID, s.ID, err)
+		case sandboxDied(sandbox.Status):
+			log.Printf("Reconciler: container '%s' in service '%s' is %s, restarting it", container.ID, s.ID, sandbox.Status)
+			if _, err := s.RestartContainer(container.ID); err != nil {
+				log.Printf("Reconciler: restarting container '%s' failed: %v", container.ID, err)
+			}
+		case sandbox.Status != container.Status:
+			container.Status = sandbox.Status
+			s.Containers[container.ID] = container
+			if err := serviceHandler.SaveService(*s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.scale(scaleDownNewest)
+}
+
+// scaleDownPolicies choose which container to remove when a service has more
+// containers than replicas.
+var scaleDownPolicies = map[string]func(s *Service) (Container, error){
+	scaleDownNewest:     newestContainer,
+	scaleDownMostLoaded: containerOnMostLoadedServer,
+}
+
+const (
+	scaleDownNewest     = "newest"
+	scaleDownMostLoaded = "most-loaded"
+)
+
+// scale creates or removes containers until the service has exactly
+// s.Replicas of them, using policy to pick the ones to remove.
+func (s *Service) scale(policy string) error {
+	pick, ok := scaleDownPolicies[policy]
+	if !ok {
+		return ValidationError("Unknown scale down policy '%s'", policy)
+	}
+
+	for len(s.Containers) < s.Replicas {
+		container, err := s.CreateContainer(s.ServiceTemplate)
+		if err != nil {
+			return err
+		}
+		log.Printf("Service '%s': created container '%s'", s.ID, container.ID)
+	}
+
+	for len(s.Containers) > s.Replicas {
+		container, err := pick(s)
+		if err != nil {
+			return err
+		}
+		if err := s.DeleteContainer(container.ID); err != nil {
+			return err
+		}
+		log.Printf("Service '%s': removed container '%s'", s.ID, container.ID)
+	}
+
+	return nil
+}
+
+func newestContainer(s *Service) (Container, error) {
+	containers := s.containersByAge()
+	return containers[len(containers)-1], nil
+}
+
+// containerOnMostLoadedServer picks the newest container on the server with
+// the highest utilization, to relieve it first.
+func containerOnMostLoadedServer(s *Service) (Container, error) {
+	loads, err := scheduler.Loads()
+	if err != nil {
+		return Container{}, err
+	}
+	utilization := make(map[string]float64, len(loads))
+	for _, load := range loads {
+		utilization[load.Server.ID] = load.Utilization()
+	}
+
+	containers := s.containersByAge()
+	selected := containers[len(containers)-1]
+	for i := len(containers) - 2; i >= 0; i-- {
+		if utilization[containers[i].ServerID] > utilization[selected.ServerID] {
+			selected = containers[i]
+		}
+	}
+	return selected, nil
+}
+
+// forgetContainer drops a container whose sandbox no longer exists.
+func (s *Service) forgetContainer(ID string) error {
+	delete(s.Containers, ID)
+	return serviceHandler.SaveService(*s)
+}
+
+// containersByAge returns the service's containers, oldest first.
+func (s *Service) containersByAge() []Container {
+	containers := make([]Container, 0, len(s.Containers))
+	for _, container := range s.Containers {
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		if containers[i].CreatedAt.Equal(containers[j].CreatedAt) {
+			return containers[i].ID < containers[j].ID
+		}
+		return containers[i].CreatedAt.Before(containers[j].CreatedAt)
+	})
+	return containers
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type SandboxExecRequest struct {
+	Command string `json:"command"`
+}
+
+type SandboxExecResult struct {
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// SandboxClient talks to the sandbox agent running on a server. host is the
+// agent's address as stored in Server.IP.
+type SandboxClient interface {
+	CreateSandbox(host string, request SandboxCreateRequest) (Sandbox, error)
+	GetSandbox(host string, ID string) (Sandbox, error)
+	ListSandboxes(host string) ([]Sandbox, error)
+	StopSandbox(host string, ID string) (Sandbox, error)
+	StartSandbox(host string, ID string) (Sandbox, error)
+	RestartSandbox(host string, ID string) (Sandbox, error)
+	DeleteSandbox(host string, ID string) error
+	SandboxLogs(host string, ID string) (string, error)
+	ExecSandbox(host string, ID string, request SandboxExecRequest) (SandboxExecResult, error)
+	// DeleteVolume deletes a volume the agent keeps in its data directory.
+	DeleteVolume(host string, name string) error
+	// Health returns nil when the agent is up and ready for sandboxes.
+	Health(host string) error
+}
+
+// NewSandboxClient returns the configured client; token is the shared
+// bootstrap token each agent's own token is derived from.
+func NewSandboxClient(config AgentConfig, token string) (SandboxClient, error) {
+	switch config.Client {
+	case "http":
+		return NewHTTPSandboxClient(time.Duration(config.TimeoutSeconds) * time.Second, token), nil
+	case "fake":
+		return NewFakeSandboxClient(), nil
+	}
+	return nil, fmt.Errorf("Unknown sandbox client '%s'", config.Client)
+}
+
+var errSandboxNotFound = NotFoundError("Sandbox not found")
+
+// HTTPSandboxClient presents each agent with its agent token, so one agent
+// can't use what it is sent to call the others.
+type HTTPSandboxClient struct {
+	client *http.Client
+	token string
+}
+
+func NewHTTPSandboxClient(timeout time.Duration, token string) *HTTPSandboxClient {
+	return &HTTPSandboxClient{client: &http.Client{Timeout: timeout}, token: token}
+}
+
+func (c *HTTPSandboxClient) CreateSandbox(host string, request SandboxCreateRequest) (Sandbox, error) {
+	var sandbox Sandbox
+	err := c.do(host, http.MethodPost, "/api/sandboxes", request, &sandbox)
+	return sandbox, err
+}
+
+func (c *HTTPSandboxClient) GetSandbox(host string, ID string) (Sandbox, error) {
+	var sandbox Sandbox
+	err := c.do(host, http.MethodGet, fmt.Sprintf("/api/sandboxes/%s", ID), nil, &sandbox)
+	return sandbox, err
+}
+
+func (c *HTTPSandboxClient) ListSandboxes(host string) ([]Sandbox, error) {
+	sandboxes := []Sandbox{}
+	err := c.do(host, http.MethodGet, "/api/sandboxes", nil, &sandboxes)
+	return sandboxes, err
+}
+
+func (c *HTTPSandboxClient) StopSandbox(host string, ID string) (Sandbox, error) {
+	return c.action(host, ID, "stop")
+}
+
+func (c *HTTPSandboxClient) StartSandbox(host string, ID string) (Sandbox, error) {
+	return c.action(host, ID, "start")
+}
+
+func (c *HTTPSandboxClient) RestartSandbox(host string, ID string) (Sandbox, error) {
+	return c.action(host, ID, "restart")
+}
+
+func (c *HTTPSandboxClient) DeleteSandbox(host string, ID string) error {
+	return c.do(host, http.MethodDelete, fmt.Sprintf("/api/sandboxes/%s", ID), nil, nil)
+}
+
+func (c *HTTPSandboxClient) SandboxLogs(host string, ID string) (string, error) {
+	var logs bytes.Buffer
+	err := c.do(host, http.MethodGet, fmt.Sprintf("/api/sandboxes/%s/logs", ID), nil, &logs)
+	return logs.String(), err
+}
+
+func (c *HTTPSandboxClient) ExecSandbox(host string, ID string, request SandboxExecRequest) (SandboxExecResult, error) {
+	var result SandboxExecResult
+	err := c.do(host, http.MethodPost, fmt.Sprintf("/api/sandboxes/%s/exec", ID), request, &result)
+	return result, err
+}
+
+func (c *HTTPSandboxClient) DeleteVolume(host string, name string) error {
+	return c.do(host, http.MethodDelete, fmt.Sprintf("/api/volumes/%s", name), nil, nil)
+}
+
+func (c *HTTPSandboxClient) Health(host string) error {
+	return c.do(host, http.MethodGet, "/api/health", nil, nil)
+}
+
+func (c *HTTPSandboxClient) action(host string, ID string, action string) (Sandbox, error) {
+	var sandbox Sandbox
+	err := c.do(host, http.MethodPost, fmt.Sprintf("/api/sandboxes/%s/%s", ID, action), nil, &sandbox)
+	return sandbox, err
+}
+
+// do sends body as JSON and decodes a successful response into result. A
+// *bytes.Buffer result receives the raw body instead.
+func (c *HTTPSandboxClient) do(host string, method string, path string, body any, result any) error {
+	var requestBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", host, path), requestBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+agentToken(c.token, host))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return AgentUnreachableError(err, "Error reaching sandbox agent at '%s'", host)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return AgentUnreachableError(err, "Error reading response from sandbox agent at '%s'", host)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errorResponse struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(responseBody, &errorResponse)
+		if errorResponse.Message == "" {
+			errorResponse.Message = resp.Status
+		}
+		switch {
+		case resp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/api/sandboxes/"):
+			// Only a sandbox's own paths mean the sandbox is gone; any other
+			// 404, such as from an agent too old to know the route, is not
+			return errSandboxNotFound
+		case resp.StatusCode == http.StatusNotFound:
+			return NotFoundError("Sandbox agent at '%s' has no %s %s: %s", host, method, path, errorResponse.Message)
+		case resp.StatusCode == http.StatusConflict:
+			return ConflictError("Sandbox agent at '%s': %s", host, errorResponse.Message)
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			// The agent and jcs disagree on the token; that's not the
+			// caller's fault
+			return AgentUnreachableError(nil, "Sandbox agent at '%s' rejected jcs's token (%d): %s", host, resp.StatusCode, errorResponse.Message)
+		case resp.StatusCode < 500:
+			return ValidationError("Sandbox agent at '%s' rejected the request: %s", host, errorResponse.Message)
+		}
+		return AgentUnreachableError(nil, "Sandbox agent at '%s' returned %d: %s", host, resp.StatusCode, errorResponse.Message)
+	}
+
+	if result == nil || len(responseBody) == 0 {
+		return nil
+	}
+	if buffer, ok := result.(*bytes.Buffer); ok {
+		buffer.Write(responseBody)
+		return nil
+	}
+	if err := json.Unmarshal(responseBody, result); err != nil {
+		return AgentUnreachableError(err, "Error decoding response from sandbox agent at '%s'", host)
+	}
+	return nil
+}
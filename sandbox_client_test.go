@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSandboxClientNotFound(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "not found"}`))
+	}))
+	defer agent.Close()
+	client := NewHTTPSandboxClient(time.Second, "s3cret")
+	host := strings.TrimPrefix(agent.URL, "http://")
+
+	if _, err := client.GetSandbox(host, "abc"); !errors.Is(err, errSandboxNotFound) {
+		t.Errorf("GetSandbox: got %v, want errSandboxNotFound", err)
+	}
+	if err := client.DeleteSandbox(host, "abc"); !errors.Is(err, errSandboxNotFound) {
+		t.Errorf("DeleteSandbox: got %v, want errSandboxNotFound", err)
+	}
+	if _, err := client.SandboxLogs(host, "abc"); !errors.Is(err, errSandboxNotFound) {
+		t.Errorf("SandboxLogs: got %v, want errSandboxNotFound", err)
+	}
+
+	// Routes that aren't about one sandbox don't mean a sandbox is gone
+	err := client.DeleteVolume(host, "data")
+	if !IsNotFound(err) || errors.Is(err, errSandboxNotFound) {
+		t.Errorf("DeleteVolume: got %v, want a not found error other than errSandboxNotFound", err)
+	}
+	if err := client.Health(host); err == nil || errors.Is(err, errSandboxNotFound) {
+		t.Errorf("Health: got %v, want a not found error other than errSandboxNotFound", err)
+	}
+	if _, err := client.CreateSandbox(host, SandboxCreateRequest{ImageName: "nginx"}); errors.Is(err, errSandboxNotFound) {
+		t.Errorf("CreateSandbox: got %v, want a not found error other than errSandboxNotFound", err)
+	}
+}
+
+func TestHTTPSandboxClientSendsToken(t *testing.T) {
+	var authorization string
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	defer agent.Close()
+	client := NewHTTPSandboxClient(time.Second, "s3cret")
+	host := strings.TrimPrefix(agent.URL, "http://")
+
+	if _, err := client.ListSandboxes(host); err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "Bearer "+agentToken("s3cret", host) {
+		t.Errorf("Authorization = %q, want the agent's own token", authorization)
+	}
+}
+
+func TestHTTPSandboxClientTokenRejected(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message": "Invalid or missing token"}`))
+		}))
+		client := NewHTTPSandboxClient(time.Second, "wrong")
+
+		_, err := client.CreateSandbox(strings.TrimPrefix(agent.URL, "http://"), SandboxCreateRequest{ImageName: "nginx"})
+		if KindOf(err) != ErrAgentUnreachable {
+			t.Errorf("%d: got %v, want an agent unreachable error", status, err)
+		}
+		agent.Close()
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Resources is what a container requests, and the limits its sandbox is run
+// with, or what a server has room for. Zero means unset: a container gets the
+// scheduler's default, and a server's disk is only checked when it is known.
+// Pids only limits a container; servers aren't scheduled by them.
+type Resources struct {
+	CPU      float64 `json:"cpu,omitempty" yaml:"cpu"`
+	MemoryMB int     `json:"memory_mb,omitempty" yaml:"memory_mb"`
+	DiskMB   int     `json:"disk_mb,omitempty" yaml:"disk_mb"`
+	Pids     int     `json:"pids,omitempty" yaml:"pids"`
+}
+
+func (r Resources) Add(other Resources) Resources {
+	return Resources{
+		CPU:      r.CPU + other.CPU,
+		MemoryMB: r.MemoryMB + other.MemoryMB,
+		DiskMB:   r.DiskMB + other.DiskMB,
+		Pids:     r.Pids + other.Pids,
+	}
+}
+
+// Validate rejects negative requests.
+func (r Resources) Validate() error {
+	if r.CPU < 0 || r.MemoryMB < 0 || r.DiskMB < 0 || r.Pids < 0 {
+		return ValidationError("Resources must not be negative")
+	}
+	return nil
+}
+
+// ServerLoad is a server together with what has already been placed on it.
+type ServerLoad struct {
+	Server        Server    `json:"server"`
+	Capacity      Resources `json:"capacity"`
+	Used          Resources `json:"used"`
+	Containers    int       `json:"containers"`
+	MaxContainers int       `json:"max_containers"`
+}
+
+func (l ServerLoad) Fits(request Resources) bool {
+	if l.MaxContainers > 0 && l.Containers+1 > l.MaxContainers {
+		return false
+	}
+	used := l.Used.Add(request)
+	if l.Capacity.DiskMB > 0 && used.DiskMB > l.Capacity.DiskMB {
+		return false
+	}
+	return used.CPU <= l.Capacity.CPU && used.MemoryMB <= l.Capacity.MemoryMB
+}
+
+// Utilization is the fraction of the server's scarcest resource in use.
+func (l ServerLoad) Utilization() float64 {
+	utilization := 0.0
+	if l.Capacity.CPU > 0 {
+		utilization = max(utilization, l.Used.CPU/l.Capacity.CPU)
+	}
+	if l.Capacity.MemoryMB > 0 {
+		utilization = max(utilization, float64(l.Used.MemoryMB)/float64(l.Capacity.MemoryMB))
+	}
+	if l.Capacity.DiskMB > 0 {
+		utilization = max(utilization, float64(l.Used.DiskMB)/float64(l.Capacity.DiskMB))
+	}
+	return utilization
+}
+
+// SchedulingStrategy picks a server for a container out of candidates that
+// all have room for it. Candidates are sorted by server ID and never empty.
+type SchedulingStrategy interface {
+	Select(candidates []ServerLoad, request Resources) ServerLoad
+}
+
+// binPackStrategy fills the busiest server first so that empty servers can be
+// reaped.
+type binPackStrategy struct{}
+
+func (binPackStrategy) Select(candidates []ServerLoad, request Resources) ServerLoad {
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.Utilization() > best.Utilization() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// spreadStrategy puts the container on the server running the fewest
+// containers, regardless of their size.
+type spreadStrategy struct{}
+
+func (spreadStrategy) Select(candidates []ServerLoad, request Resources) ServerLoad {
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.Containers < best.Containers {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// leastLoadedStrategy puts the container on the server with the most spare
+// CPU and memory.
+type leastLoadedStrategy struct{}
+
+func (leastLoadedStrategy) Select(candidates []ServerLoad, request Resources) ServerLoad {
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.Utilization() < best.Utilization() {
+			best = candidate
+		}
+	}
+	return best
+}
+
+var schedulingStrategies = map[string]SchedulingStrategy{
+	"binpack":      binPackStrategy{},
+	"spread":       spreadStrategy{},
+	"least-loaded": leastLoadedStrategy{},
+}
+
+var errNoCapacity = errors.New("No server has capacity for the container")
+
+type Scheduler struct {
+	mu          sync.Mutex
+	provisionMu sync.Mutex
+	strategy    SchedulingStrategy
+	config      SchedulerConfig
+	// pending holds resources promised to containers that are still being
+	// created, keyed by reservation ID, so concurrent placements see them.
+	pending map[string]reservation
+}
+
+type reservation struct {
+	serverID  string
+	resources Resources
+}
+
+func NewScheduler(config SchedulerConfig) (*Scheduler, error) {
+	strategy, ok := schedulingStrategies[config.Strategy]
+	if !ok {
+		return nil, fmt.Errorf("Unknown scheduling strategy '%s'", config.Strategy)
+	}
+	return &Scheduler{
+		strategy: strategy,
+		config:   config,
+		pending:  make(map[string]reservation),
+	}, nil
+}
+
+// Place picks a server with room for request, provisioning a new one through
+// the server adapter only when none of the existing servers fit. A container
+// whose volumes are attached to a server is pinned to it: pinnedServerID
+// names that server, and nothing else is considered. The returned release
+// function must be called once the container has been recorded on its
+// service (or has failed to start).
+func (s *Scheduler) Place(request Resources, pinnedServerID string) (Server, func(), error) {
+	if err := request.Validate(); err != nil {
+		return Server{}, nil, err
+	}
+	request = s.withDefaults(request)
+	if pinnedServerID != "" {
+		return s.placeOn(pinnedServerID, request)
+	}
+
+	server, release, err := s.placeOnExisting(request)
+	if !errors.Is(err, errNoCapacity) {
+		return server, release, err
+	}
+
+	// Only one request provisions at a time; the others wait here and then
+	// usually fit on the server it created.
+	s.provisionMu.Lock()
+	defer s.provisionMu.Unlock()
+
+	server, release, err = s.placeOnExisting(request)
+	if !errors.Is(err, errNoCapacity) {
+		return server, release, err
+	}
+
+	if !s.fitsEmptyServer(request) {
+		return Server{}, nil, ValidationError("Container requesting %.2f CPU, %dMB memory and %dMB disk does not fit on a new server", request.CPU, request.MemoryMB, request.DiskMB)
+	}
+	randomString, err := randomHex(3)
+	if err != nil {
+		return Server{}, nil, err
+	}
+	server, err = serverHandler.CreateServer(fmt.Sprintf("jcs-%s", randomString), "", "")
+	if err != nil {
+		return Server{}, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return server, s.reserveLocked(server.ID, request), nil
+}
+
+func (s *Scheduler) placeOnExisting(request Resources) (Server, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loads, err := s.loadsLocked()
+	if err != nil {
+		return Server{}, nil, err
+	}
+	candidates := []ServerLoad{}
+	for _, load := range loads {
+		if load.Server.Schedulable() && load.Fits(request) {
+			candidates = append(candidates, load)
+		}
+	}
+	if len(candidates) == 0 {
+		return Server{}, nil, errNoCapacity
+	}
+
+	selected := s.strategy.Select(candidates, request)
+	if selected.Containers == 0 && warmPool != nil {
+		// A warm server just got used
+		warmPool.Trigger()
+	}
+	return selected.Server, s.reserveLocked(selected.Server.ID, request), nil
+}
+
+// placeOn places request on the given server or fails; a pinned container
+// never provisions a new server.
+func (s *Scheduler) placeOn(serverID string, request Resources) (Server, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loads, err := s.loadsLocked()
+	if err != nil {
+		return Server{}, nil, err
+	}
+	for _, load := range loads {
+		if load.Server.ID != serverID {
+			continue
+		}
+		if !load.Server.Schedulable() {
+			return Server{}, nil, ConflictError("Server '%s' holding the container's volumes is not accepting containers", serverID)
+		}
+		if !load.Fits(request) {
+			return Server{}, nil, ConflictError("Server '%s' holding the container's volumes has no room for %.2f CPU, %dMB memory and %dMB disk", serverID, request.CPU, request.MemoryMB, request.DiskMB)
+		}
+		return load.Server, s.reserveLocked(serverID, request), nil
+	}
+	return Server{}, nil, ConflictError("Server '%s' holding the container's volumes no longer exists", serverID)
+}
+
+func (s *Scheduler) reserveLocked(serverID string, request Resources) func() {
+	id, _ := randomHex(8)
+	s.pending[id] = reservation{serverID: serverID, resources: request}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.pending, id)
+	}
+}
+
+// placing reports whether containers are being created on the server right
+// now, i.e. may have sandboxes there that aren't recorded yet.
+func (s *Scheduler) placing(serverID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pending := range s.pending {
+		if pending.serverID == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads reports the capacity and usage of every server, sorted by server ID.
+func (s *Scheduler) Loads() ([]ServerLoad, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadsLocked()
+}
+
+func (s *Scheduler) loadsLocked() ([]ServerLoad, error) {
+	servers, err := serverHandler.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+
+	loads := make([]ServerLoad, 0, len(servers))
+	byID := make(map[string]int, len(servers))
+	for _, server := range servers {
+		byID[server.ID] = len(loads)
+		loads = append(loads, ServerLoad{Server: server, Capacity: s.capacityOf(server), MaxContainers: s.config.MaxContainersPerServer})
+	}
+
+	containers, err := serviceHandler.ListAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if i, ok := byID[container.ServerID]; ok {
+			loads[i].Used = loads[i].Used.Add(s.withDefaults(container.Resources))
+			loads[i].Containers++
+		}
+	}
+	for _, pending := range s.pending {
+		if i, ok := byID[pending.serverID]; ok {
+			loads[i].Used = loads[i].Used.Add(pending.resources)
+			loads[i].Containers++
+		}
+	}
+
+	return loads, nil
+}
+
+func (s *Scheduler) capacityOf(server Server) Resources {
+	capacity := server.Capacity
+	if capacity.CPU == 0 {
+		capacity.CPU = s.config.ServerCapacity.CPU
+	}
+	if capacity.MemoryMB == 0 {
+		capacity.MemoryMB = s.config.ServerCapacity.MemoryMB
+	}
+	if capacity.DiskMB == 0 {
+		capacity.DiskMB = s.config.ServerCapacity.DiskMB
+	}
+	return capacity
+}
+
+func (s *Scheduler) withDefaults(request Resources) Resources {
+	if request.CPU == 0 {
+		request.CPU = s.config.DefaultResources.CPU
+	}
+	if request.MemoryMB == 0 {
+		request.MemoryMB = s.config.DefaultResources.MemoryMB
+	}
+	if request.DiskMB == 0 {
+		request.DiskMB = s.config.DefaultResources.DiskMB
+	}
+	if request.Pids == 0 {
+		request.Pids = s.config.DefaultResources.Pids
+	}
+	return request
+}
+
+func (s *Scheduler) fitsEmptyServer(request Resources) bool {
+	empty := ServerLoad{Capacity: s.config.ServerCapacity, MaxContainers: s.config.MaxContainersPerServer}
+	return empty.Fits(request)
+}
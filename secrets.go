@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is what the API shows of a secret: never its value.
+type Secret struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StoredSecret is a secret as persisted, with its value encrypted under the
+// master key. The secret's name is authenticated along with the value, so a
+// ciphertext can't be moved to another name.
+type StoredSecret struct {
+	Name       string    `json:"name"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type SecretCreateRequest struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type SecretUpdateRequest struct {
+	Value string `json:"value"`
+}
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// SecretHandler keeps secrets encrypted at rest and only decrypts them to
+// hand them to a sandbox agent when a container is created. pins counts the
+// services and containers that checked a secret exists but haven't saved
+// their reference to it yet, so DeleteSecret can't delete it in between.
+type SecretHandler struct {
+	mu      sync.RWMutex
+	secrets map[string]StoredSecret
+	pins    map[string]int
+	store   Store
+	aead    cipher.AEAD
+}
+
+// NewSecretHandler loads the stored secrets and checks they all decrypt with
+// key, so a wrong master key is caught at startup rather than when a
+// container next starts.
+func NewSecretHandler(store Store, key []byte) (*SecretHandler, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secrets master key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	storedSecrets, err := store.ListSecrets()
+	if err != nil {
+		return nil, err
+	}
+	handler := &SecretHandler{secrets: make(map[string]StoredSecret), pins: make(map[string]int), store: store, aead: aead}
+	for _, secret := range storedSecrets {
+		if _, err := handler.decrypt(secret); err != nil {
+			return nil, err
+		}
+		handler.secrets[secret.Name] = secret
+	}
+	return handler, nil
+}
+
+// loadMasterKey reads the base64 AES-256 key at path, generating one the
+// first time. Losing the file makes every stored secret unreadable.
+func loadMasterKey(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key)
+		// O_EXCL so a key some other process just wrote is never replaced
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating secrets master key '%s': %v", path, err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(encoded + "\n"); err != nil {
+			return nil, fmt.Errorf("Error writing secrets master key '%s': %v", path, err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading secrets master key '%s': %v", path, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Secrets master key '%s' must hold 32 bytes encoded as base64", path)
+	}
+	return key, nil
+}
+
+func (s *SecretHandler) ListSecrets() []Secret {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secrets := make([]Secret, 0, len(s.secrets))
+	for _, secret := range s.secrets {
+		secrets = append(secrets, secret.public())
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets
+}
+
+func (s *SecretHandler) GetSecret(name string) (Secret, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return Secret{}, NotFoundError("Secret not found with name '%s'", name)
+	}
+	return secret.public(), nil
+}
+
+func (s *SecretHandler) CreateSecret(name string, value string) (Secret, error) {
+	if !secretNamePattern.MatchString(name) {
+		return Secret{}, ValidationError("Secret name '%s' may only contain letters, digits, '_', '.' and '-'", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.secrets[name]; ok {
+		return Secret{}, ConflictError("A secret already exists with the name '%s'", name)
+	}
+	now := time.Now().UTC()
+	return s.saveLocked(StoredSecret{Name: name, CreatedAt: now, UpdatedAt: now}, value)
+}
+
+// UpdateSecret replaces a secret's value. Running containers keep the value
+// they were started with until they are redeployed.
+func (s *SecretHandler) UpdateSecret(name string, value string) (Secret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.secrets[name]
+	if !ok {
+		return Secret{}, NotFoundError("Secret not found with name '%s'", name)
+	}
+	secret.UpdatedAt = time.Now().UTC()
+	return s.saveLocked(secret, value)
+}
+
+// DeleteSecret refuses while a service or container still references the
+// secret, or is about to, since their next container would fail to start.
+func (s *SecretHandler) DeleteSecret(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.secrets[name]; !ok {
+		return NotFoundError("Secret not found with name '%s'", name)
+	}
+	if s.pins[name] > 0 {
+		return ConflictError("Secret '%s' is being used by a service or container that is being saved", name)
+	}
+	if users := serviceHandler.secretUsers(name); len(users) > 0 {
+		return ConflictError("Secret '%s' is still used by %s", name, strings.Join(users, ", "))
+	}
+
+	if err := s.store.DeleteSecret(name); err != nil {
+		return err
+	}
+	delete(s.secrets, name)
+	return nil
+}
+
+// pin keeps the secrets refs refers to from being deleted until the returned
+// function is called, which callers do once the references are saved. It
+// fails if one of them doesn't exist.
+func (s *SecretHandler) pin(refs map[string]string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for variable, name := range refs {
+		if _, ok := s.secrets[name]; !ok {
+			return nil, ValidationError("Secret '%s' referenced by %s does not exist", name, variable)
+		}
+	}
+	for _, name := range refs {
+		s.pins[name]++
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, name := range refs {
+			if s.pins[name]--; s.pins[name] == 0 {
+				delete(s.pins, name)
+			}
+		}
+	}, nil
+}
+
+// Exists reports whether a secret with the name exists.
+func (s *SecretHandler) Exists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.secrets[name]
+	return ok
+}
+
+// Resolve decrypts the secrets referenced by refs, which maps environment
+// variable names to secret names, into environment variable values.
+func (s *SecretHandler) Resolve(refs map[string]string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make(map[string]string, len(refs))
+	for variable, name := range refs {
+		secret, ok := s.secrets[name]
+		if !ok {
+			return nil, ValidationError("Secret '%s' referenced by %s does not exist", name, variable)
+		}
+		value, err := s.decrypt(secret)
+		if err != nil {
+			return nil, err
+		}
+		values[variable] = value
+	}
+	return values, nil
+}
+
+// saveLocked encrypts value into secret and persists it. Callers hold s.mu.
+func (s *SecretHandler) saveLocked(secret StoredSecret, value string) (Secret, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Secret{}, err
+	}
+	secret.Nonce = nonce
+	secret.Ciphertext = s.aead.Seal(nil, nonce, []byte(value), []byte(secret.Name))
+	if err := s.store.SaveSecret(secret); err != nil {
+		return Secret{}, err
+	}
+	s.secrets[secret.Name] = secret
+	return secret.public(), nil
+}
+
+func (s *SecretHandler) decrypt(secret StoredSecret) (string, error) {
+	value, err := s.aead.Open(nil, secret.Nonce, secret.Ciphertext, []byte(secret.Name))
+	if err != nil {
+		return "", fmt.Errorf("Secret '%s' can't be decrypted with the configured master key", secret.Name)
+	}
+	return string(value), nil
+}
+
+func (s StoredSecret) public() Secret {
+	return Secret{Name: s.Name, CreatedAt: s.CreatedAt, UpdatedAt: s.UpdatedAt}
+}
+
+// secretUsers lists the services and containers that reference the secret.
+func (s *ServiceHandler) secretUsers(name string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []string{}
+	for _, service := range s.Services {
+		if references(service.Secrets, name) {
+			users = append(users, fmt.Sprintf("service '%s'", service.Name))
+		}
+		for _, container := range service.Containers {
+			if references(container.Secrets, name) {
+				users = append(users, fmt.Sprintf("container '%s'", container.ID))
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+func references(refs map[string]string, name string) bool {
+	for _, secretName := range refs {
+		if secretName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// slowCreates is a FakeSandboxClient that calls during with each sandbox it
+// creates, before the container is saved.
+type slowCreates struct {
+	*FakeSandboxClient
+	during func()
+}
+
+func (s slowCreates) CreateSandbox(host string, request SandboxCreateRequest) (Sandbox, error) {
+	s.during()
+	return s.FakeSandboxClient.CreateSandbox(host, request)
+}
+
+func TestDeleteSecretRefusesWhileContainersAreCreated(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secretHandler.CreateSecret("token", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the secret while a container that references it is being
+	// created: its secrets are resolved but it isn't saved yet. The delete
+	// neither waits for the create nor goes through
+	sandboxClient = slowCreates{fake, func() {
+		deleted := make(chan error, 1)
+		go func() { deleted <- secretHandler.DeleteSecret("token") }()
+		select {
+		case err := <-deleted:
+			if KindOf(err) != ErrConflict {
+				t.Errorf("DeleteSecret during the create: got %v, want a conflict", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("DeleteSecret waited for the container to be created")
+		}
+	}}
+	container, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{Secrets: map[string]string{"TOKEN": "token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandboxClient = fake
+	if err := secretHandler.DeleteSecret("token"); KindOf(err) != ErrConflict {
+		t.Errorf("DeleteSecret: got %v, want a conflict with the new container", err)
+	}
+
+	// Once nothing refers to it any more, it can go
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretHandler.DeleteSecret("token"); err != nil {
+		t.Errorf("DeleteSecret after the container is gone: %v", err)
+	}
+}
@@ -1,7 +1,60 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
 type ServerAdapter interface {
 	ListServers() ([]RemoteServer, error)
 	GetServer(id string) (RemoteServer, error)
-	CreateServer(name string) (RemoteServer, error)
+	// CreateServer starts a server whose agent phones home and registers
+	// with bootstrapToken.
+	CreateServer(name string, serverType string, location string, bootstrapToken string) (RemoteServer, error)
+	DeleteServer(id string) error
+}
+
+func NewServerAdapter(config Config) (ServerAdapter, error) {
+	switch config.Provider {
+	case "local":
+		return NewLocalServerAdapter(config.Local, config.Bootstrap)
+	case "hetzner":
+		api := NewHetznerApiClient(config.Hetzner.BaseURL, config.Hetzner.APIKey, &http.Client{Timeout: 30 * time.Second})
+		return NewHetznerServerAdapter(config.Hetzner, config.Bootstrap, api), nil
+	}
+	return nil, fmt.Errorf("Unknown provider '%s'", config.Provider)
+}
+
+var errWaitTimedOut = errors.New("timed out")
+
+// waitFor calls check every interval until it reports done, returns an error,
+// or timeout passes, in which case it returns errWaitTimedOut.
+func waitFor(timeout time.Duration, interval time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return errWaitTimedOut
+		}
+		time.Sleep(interval)
+	}
+}
+
+// transient reports whether err is worth polling through: the provider or
+// agent was unavailable or overloaded (5xx, 429, timeouts) rather than
+// rejecting the request.
+func transient(err error) bool {
+	switch KindOf(err) {
+	case ErrProviderUnavailable, ErrAgentUnreachable:
+		return true
+	}
+	return false
 }
@@ -1,50 +1,134 @@
 package main
 
 import (
-	"log"
+	"context"
 	"fmt"
-	"github.com/joho/godotenv"
-	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
+// ServerHandler is shared by every request goroutine; mu guards Servers and
+// createMu guards creating, the names of servers still being provisioned, so
+// two requests can't race to create servers with the same name. tokensMu
+// guards bootstrapTokens.
 type ServerHandler struct {
+	mu sync.RWMutex
+	createMu sync.Mutex
+	creating map[string]bool
 	Servers map[string]Server
 	ServerAdapter ServerAdapter
+	store Store
+	// agentReadyTimeout is how long a new server's agent has to become healthy.
+	agentReadyTimeout time.Duration
+	// token is the shared bootstrap token; it never leaves the control plane
+	// except to agents an operator starts by hand.
+	token string
+	tokensMu sync.Mutex
+	// bootstrapTokens holds the single-use tokens new servers phone home and
+	// first register with, by server name. They only live in memory: a
+	// restart loses creates still in flight anyway.
+	bootstrapTokens map[string]*bootstrapToken
+	// sweeping holds the servers whose orphaned sandboxes are being deleted.
+	sweeping map[string]bool
 }
 
-func NewServerHandler() *ServerHandler {
+func NewServerHandler(store Store, serverAdapter ServerAdapter, agentReadyTimeout time.Duration, token string) (*ServerHandler, error) {
 	servers := make(map[string]Server)
-	// instead of this, we should get the API key from a "config"
-	err := godotenv.Load()
-    if err != nil {
-        log.Println("Warning: Error loading .env file")
-    }
-	serverAdapter := LocalServerAdapter{} // TODO: set this based on the user's config settings
+	storedServers, err := store.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range storedServers {
+		servers[server.ID] = server
+	}
+
 	remoteServers, err := serverAdapter.ListServers()
 	if err == nil {
 		for _, remoteServer := range remoteServers {
+			if server, ok := findServerByRemoteID(servers, remoteServer); ok {
+				server.Status = remoteServer.Status
+				server.IP = remoteServer.IP
+				server.Capacity = remoteServer.Capacity
+				server.Owned = remoteServer.Owned
+				if err := store.SaveServer(server); err != nil {
+					return nil, err
+				}
+				servers[server.ID] = server
+				continue
+			}
 			id, _ := randomHex(3)
-			serverID := fmt.Sprintf("%s%s", remoteServer.ID, id)
-			server := Server{ID: serverID, RemoteID: remoteServer.ID, Name: remoteServer.Name, Type: remoteServer.Type, Status: remoteServer.Status, IP: remoteServer.IP}
-			servers[serverID] = server
+			server := newServerFromRemote(remoteServer, id)
+			if err := store.SaveServer(server); err != nil {
+				return nil, err
+			}
+			servers[server.ID] = server
 		}
 	}
 
     return &ServerHandler{
         Servers: servers,
+		creating: make(map[string]bool),
 		ServerAdapter: serverAdapter,
-    }
+		store: store,
+		agentReadyTimeout: agentReadyTimeout,
+		token: token,
+		bootstrapTokens: make(map[string]*bootstrapToken),
+		sweeping: make(map[string]bool),
+    }, nil
+}
+
+// Schedulable reports whether new containers may be placed on the server.
+func (s Server) Schedulable() bool {
+	if s.Cordoned {
+		return false
+	}
+	switch s.Status {
+	case "running", "online":
+		return true
+	}
+	return false
+}
+
+func newServerFromRemote(remoteServer RemoteServer, id string) Server {
+	return Server{
+		ID: fmt.Sprintf("%s%s", remoteServer.ID, id),
+		RemoteID: remoteServer.ID,
+		Name: remoteServer.Name,
+		Type: remoteServer.Type,
+		ServerType: remoteServer.ServerType,
+		Location: remoteServer.Location,
+		Capacity: remoteServer.Capacity,
+		Status: remoteServer.Status,
+		IP: remoteServer.IP,
+		Owned: remoteServer.Owned,
+	}
+}
+
+func findServerByRemoteID(servers map[string]Server, remoteServer RemoteServer) (Server, bool) {
+	for _, server := range servers {
+		if server.RemoteID == remoteServer.ID && server.Type == remoteServer.Type {
+			return server, true
+		}
+	}
+	return Server{}, false
 }
 
 func (s *ServerHandler) GetServer(ID string) (Server, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	server, ok := s.Servers[ID]
 	if !ok {
-		return server, errors.New(fmt.Sprintf("Server not found with ID '%s'", ID))
+		return server, NotFoundError("Server not found with ID '%s'", ID)
 	}
 	return server, nil
 }
 
 func (s *ServerHandler) ListServers() ([]Server, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	servers := make([]Server, 0, len(s.Servers))
 	for _, server := range s.Servers {
 		servers = append(servers, server)
@@ -53,16 +137,32 @@ func (s *ServerHandler) ListServers() ([]Server, error) {
 	return servers, nil
 }
 
-func (s *ServerHandler) CreateServer(name string) (Server, error) {
+// CreateServer provisions a server and returns once its agent passes its
+// health check. Until then the server is recorded as "provisioning" so the
+// scheduler leaves it alone. If the agent never comes up the server is
+// deprovisioned again rather than left running up the bill; should that fail
+// too, it stays behind as "unreachable" for the reaper.
+func (s *ServerHandler) CreateServer(name string, serverType string, location string) (Server, error) {
 	var newServer Server
-	for _, server := range s.Servers {
-		if server.Name == name {
-			return newServer, errors.New(fmt.Sprintf("A server already exists with the name '%s'", name))
-		}
+	if err := validateServerName(name); err != nil {
+		return newServer, err
+	}
+	if err := s.reserveName(name); err != nil {
+		return newServer, err
 	}
+	defer func() {
+		s.createMu.Lock()
+		delete(s.creating, name)
+		s.createMu.Unlock()
+	}()
 
-	remoteServer, err := s.ServerAdapter.CreateServer(name)
+	token, err := s.issueBootstrapToken(name)
+	if err != nil {
+		return newServer, err
+	}
+	remoteServer, err := s.ServerAdapter.CreateServer(name, serverType, location, token)
 	if err != nil {
+		s.revokeBootstrapToken(name)
 		return newServer, err
 	}
 
@@ -70,21 +170,226 @@ func (s *ServerHandler) CreateServer(name string) (Server, error) {
 	if err != nil {
 		return newServer, err
 	}
-	serverID := fmt.Sprintf("%s%s", remoteServer.ID, id)
-	newServer = Server{ID: serverID, RemoteID: remoteServer.ID, Name: remoteServer.Name, Type: remoteServer.Type, Status: remoteServer.Status, IP: remoteServer.IP}
+	newServer = newServerFromRemote(remoteServer, id)
+	newServer.Status = "provisioning"
+	s.mu.Lock()
+	if err := s.store.SaveServer(newServer); err != nil {
+		s.mu.Unlock()
+		return Server{}, err
+	}
 	s.Servers[newServer.ID] = newServer
+	s.mu.Unlock()
 
-	return newServer, nil
+	var healthErr error
+	err = waitFor(s.agentReadyTimeout, agentReadyPollInterval, func() (bool, error) {
+		healthErr = sandboxClient.Health(newServer.IP)
+		return healthErr == nil, nil
+	})
+	if err != nil {
+		s.abandon(newServer)
+		return Server{}, AgentUnreachableError(healthErr, "The agent on server '%s' didn't become healthy within %s", newServer.ID, s.agentReadyTimeout)
+	}
+	if err := s.setStatus(newServer.ID, remoteServer.Status); err != nil {
+		return Server{}, err
+	}
+
+	return s.GetServer(newServer.ID)
 }
 
+const agentReadyPollInterval = 2 * time.Second
+
+// abandon deprovisions a new server whose agent never came up and forgets it.
+func (s *ServerHandler) abandon(server Server) {
+	if err := s.ServerAdapter.DeleteServer(server.RemoteID); err != nil && !IsNotFound(err) {
+		log.Printf("Error deprovisioning server '%s' whose agent never came up, leaving it to the reaper: %v", server.ID, err)
+		s.setStatus(server.ID, "unreachable")
+		return
+	}
+	log.Printf("Deprovisioned server '%s' whose agent never came up", server.ID)
+	s.revokeBootstrapToken(server.Name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.DeleteServer(server.ID); err != nil {
+		log.Printf("Error forgetting server '%s': %v", server.ID, err)
+		return
+	}
+	delete(s.Servers, server.ID)
+}
+
+// serverNamePattern keeps server names usable as host names and as the local
+// provider's directory names.
+var serverNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func validateServerName(name string) error {
+	if !serverNamePattern.MatchString(name) {
+		return ValidationError("Server name '%s' may only contain lowercase letters, digits and '-'", name)
+	}
+	return nil
+}
+
+func (s *ServerHandler) reserveName(name string) error {
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+
+	if s.creating[name] {
+		return ConflictError("A server already exists with the name '%s'", name)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, server := range s.Servers {
+		if server.Name == name {
+			return ConflictError("A server already exists with the name '%s'", name)
+		}
+	}
+	s.creating[name] = true
+	return nil
+}
+
+// DeleteServer deprovisions the server at its provider and forgets it. It
+// refuses while containers are still placed on the server.
 func (s *ServerHandler) DeleteServer(ID string) error {
+	server, err := s.GetServer(ID)
+	if err != nil {
+		return err
+	}
+
+	// Stop the scheduler from placing anything new here before checking
+	// whether the server is empty.
+	previousStatus := server.Status
+	if err := s.setStatus(ID, "deleting"); err != nil {
+		return err
+	}
+	loads, err := scheduler.Loads()
+	if err != nil {
+		s.setStatus(ID, previousStatus)
+		return err
+	}
+	for _, load := range loads {
+		if load.Server.ID == ID && load.Containers > 0 {
+			s.setStatus(ID, previousStatus)
+			return ConflictError("Server '%s' still has %d containers placed on it", ID, load.Containers)
+		}
+	}
+	if names := volumeHandler.localVolumes(ID); len(names) > 0 {
+		s.setStatus(ID, previousStatus)
+		return ConflictError("Server '%s' still holds local volumes %s", ID, strings.Join(names, ", "))
+	}
+
+	// Servers that only registered through their agent have nothing to
+	// deprovision at the provider
+	if server.Type != "agent" {
+		err = s.ServerAdapter.DeleteServer(server.RemoteID)
+	}
+	if err != nil && !IsNotFound(err) {
+		s.setStatus(ID, previousStatus)
+		return err
+	}
+
+	s.mu.Lock()
+	if err := s.store.DeleteServer(server.ID); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.Servers, server.ID)
+	s.mu.Unlock()
+	s.revokeBootstrapToken(server.Name)
+	volumeHandler.serverDeleted(server.ID)
+
+	return nil
+}
+
+// SetCordoned marks whether the scheduler may place new containers on the
+// server. Containers already there keep running.
+func (s *ServerHandler) SetCordoned(ID string, cordoned bool) (Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	server, ok := s.Servers[ID]
 	if !ok {
-		return errors.New(fmt.Sprintf("Server not found with ID '%s'", ID))
+		return server, NotFoundError("Server not found with ID '%s'", ID)
+	}
+	server.Cordoned = cordoned
+	if err := s.store.SaveServer(server); err != nil {
+		return Server{}, err
 	}
+	s.Servers[ID] = server
 
-	// TODO: delete from remote?
-	delete(s.Servers, server.ID)
+	return server, nil
+}
+
+// DrainServer cordons the server and moves each of its containers to other
+// servers, starting the replacement before stopping the original. Containers
+// mounting a local volume are left where they are, since the volume can't
+// follow them. It returns the replacements.
+func (s *ServerHandler) DrainServer(ctx context.Context, ID string, run *OperationRun) ([]Container, error) {
+	if _, err := s.SetCordoned(ID, true); err != nil {
+		return nil, err
+	}
+
+	containers, err := serviceHandler.ListServerContainers(ID)
+	if err != nil {
+		return nil, err
+	}
+	moved := []Container{}
+	for i, container := range containers {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		if name, ok := volumeHandler.localMount(container.Mounts); ok {
+			run.Step(100*i/len(containers), "Skipping container '%s' of service '%s': its local volume '%s' can't leave this server", container.ID, container.ServiceID, name)
+			continue
+		}
+		run.Step(100*i/len(containers), "Moving container '%s' of service '%s'", container.ID, container.ServiceID)
+		replacement, err := serviceHandler.MoveContainer(container.ServiceID, container.ID)
+		if IsNotFound(err) {
+			// Deleted while we were draining
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+		moved = append(moved, replacement)
+	}
+
+	return moved, nil
+}
+
+// PhoneHome records the SSH host keys a new server reports from cloud-init,
+// so they can be pinned when connecting to it. token must be the server's
+// bootstrap token, which is good for one phone home.
+func (s *ServerHandler) PhoneHome(name string, token string, hostKeys []string) (Server, error) {
+	if !s.useBootstrapToken(name, token, phoneHomeUse) {
+		return Server{}, UnauthorizedError("Invalid bootstrap token for server '%s'", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range s.Servers {
+		if server.Name != name {
+			continue
+		}
+		server.SSHHostKeys = hostKeys
+		if err := s.store.SaveServer(server); err != nil {
+			return Server{}, err
+		}
+		s.Servers[server.ID] = server
+		log.Printf("Server '%s' phoned home with %d SSH host keys", server.ID, len(hostKeys))
+		return server, nil
+	}
+	return Server{}, NotFoundError("Server not found with name '%s'", name)
+}
+
+func (s *ServerHandler) setStatus(ID string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server, ok := s.Servers[ID]
+	if !ok {
+		return NotFoundError("Server not found with ID '%s'", ID)
+	}
+	server.Status = status
+	if err := s.store.SaveServer(server); err != nil {
+		return err
+	}
+	s.Servers[ID] = server
 
 	return nil
 }
@@ -100,6 +405,4 @@ func (s *ServerHandler) generateId() (string, error) {
 			return id, nil
 		}
 	}
-
-	return "", fmt.Errorf("Could not generate server ID")
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// deadAgents is a FakeSandboxClient whose agents never pass their health
+// check.
+type deadAgents struct {
+	*FakeSandboxClient
+}
+
+func (d deadAgents) Health(host string) error {
+	return AgentUnreachableError(errors.New("connection refused"), "Error reaching sandbox agent at '%s'", host)
+}
+
+// recordingServerAdapter remembers which servers were deleted.
+type recordingServerAdapter struct {
+	ServerAdapter
+	deleted []string
+}
+
+func (r *recordingServerAdapter) DeleteServer(ID string) error {
+	r.deleted = append(r.deleted, ID)
+	return r.ServerAdapter.DeleteServer(ID)
+}
+
+func TestCreateServerDeprovisionsUnhealthyServers(t *testing.T) {
+	fake := newTestCluster(t)
+	sandboxClient = deadAgents{fake}
+	adapter := &recordingServerAdapter{ServerAdapter: serverHandler.ServerAdapter}
+	serverHandler.ServerAdapter = adapter
+
+	_, err := serverHandler.CreateServer("jcs-dead", "", "")
+	if KindOf(err) != ErrAgentUnreachable {
+		t.Fatalf("CreateServer: got %v, want an agent unreachable error", err)
+	}
+	if len(adapter.deleted) != 1 || adapter.deleted[0] != "localhost-jcs-dead" {
+		t.Errorf("deprovisioned %v, want the new server", adapter.deleted)
+	}
+	servers, err := serverHandler.ListServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		if server.Name == "jcs-dead" {
+			t.Errorf("server %+v is still recorded", server)
+		}
+	}
+}
+
+func TestDrainServerLeavesLocalVolumeContainers(t *testing.T) {
+	newTestCluster(t)
+	handler := newRouter(defaultConfig())
+	if _, err := serverHandler.CreateServer("jcs-b", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volumeHandler.CreateVolume(VolumeCreateRequest{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := serviceHandler.CreateService("db", ServiceTemplate{ImageName: "postgres", Mounts: []VolumeMount{{Volume: "data", Path: "/data"}}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := serviceHandler.CreateContainer(db.ID, ServiceTemplate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceHandler.CreateContainer(web.ID, ServiceTemplate{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var operation Operation
+	if code := apiRequest(t, handler, http.MethodPost, "/api/servers/"+pinned.ServerID+"/drain", nil, &operation); code != http.StatusAccepted {
+		t.Fatalf("draining: %d", code)
+	}
+	operation = waitForOperation(t, handler, operation)
+	if operation.Status != OperationSucceeded {
+		t.Fatalf("draining failed: %s", operation.Error)
+	}
+	skipped := false
+	for _, step := range operation.Steps {
+		skipped = skipped || strings.Contains(step.Message, "Skipping container '"+pinned.ID+"'")
+	}
+	if !skipped {
+		t.Errorf("steps %+v don't say container '%s' was skipped", operation.Steps, pinned.ID)
+	}
+
+	containers, err := serviceHandler.ListServerContainers(pinned.ServerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != pinned.ID {
+		t.Errorf("drained server still has %+v, want only the container with the local volume", containers)
+	}
+}
+
+func TestCreateServerRejectsUnsafeNames(t *testing.T) {
+	newTestCluster(t)
+	for _, name := range []string{"../../etc", "a/b", "..", "Web", "-web", ""} {
+		if _, err := serverHandler.CreateServer(name, "", ""); KindOf(err) != ErrValidation {
+			t.Errorf("creating server '%s': %v, want a validation error", name, err)
+		}
+	}
+	if servers, _ := serverHandler.ListServers(); len(servers) != 1 {
+		t.Errorf("%d servers, want just localhost", len(servers))
+	}
+}
+
+func TestLocalAgentDirStaysInDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	adapter := &LocalServerAdapter{config: LocalConfig{DataDir: dataDir}}
+	for _, name := range []string{"../../etc", "..", "", "a/../.."} {
+		if dir, err := adapter.agentDir(&localAgent{Name: name}); err == nil {
+			t.Errorf("agent '%s' got directory '%s' outside '%s'", name, dir, dataDir)
+		}
+	}
+	if _, err := adapter.agentDir(&localAgent{Name: "jcs-a"}); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,74 +2,77 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"net/http"
-	"io"
-	"log"
-	"bytes"
-	"encoding/json"
+	"time"
 )
 
+// ServiceTemplate describes the containers the reconciler runs for a
+// service. A service without an image is unmanaged: its containers are only
+// the ones created through the API.
+type ServiceTemplate struct {
+	ImageName string `json:"image_name,omitempty"`
+	StartCommand string `json:"start_command,omitempty"`
+	Resources Resources `json:"resources,omitempty"`
+	// Env holds plain environment variables; Secrets maps environment
+	// variables to the names of secrets their values come from.
+	Env map[string]string `json:"env,omitempty"`
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// Mounts attach volumes to the containers, which pins them to the
+	// server the volumes are on.
+	Mounts []VolumeMount `json:"mounts,omitempty"`
+}
+
 type Service struct {
 	ID string `json:"id"`
 	Name string `json:"name"`
+	ServiceTemplate
+	Replicas int `json:"replicas"`
 	Containers map[string]Container `json:"containers"`
+	Events []ServiceEvent `json:"events,omitempty"`
 }
 
-func (s *Service) CreateContainer(imageName string, startCommand string) (Container, error) {
-	var newContainer Container
-
-	result, err := serverHandler.ListServers()
-	if err != nil {
-		return newContainer, err
-	}
+func (s Service) Managed() bool {
+	return s.ImageName != ""
+}
 
-	var server Server
-	if len(result) < 1 {
-		randomString, err := randomHex(3)
-		if err != nil {
-			return newContainer, err
-		}
-		server, err = serverHandler.CreateServer(fmt.Sprintf("jcs-%s", randomString))
-		if err != nil {
-			return newContainer, err
-		}
-	} else {
-		server = result[0] // TODO: eventually select a server that has capacity
+func (s Service) clone() Service {
+	containers := make(map[string]Container, len(s.Containers))
+	for id, container := range s.Containers {
+		containers[id] = container
 	}
+	s.Containers = containers
+	s.Events = append([]ServiceEvent(nil), s.Events...)
+	s.Mounts = append([]VolumeMount(nil), s.Mounts...)
+	return s
+}
 
-	sandboxCreateRequest := SandboxCreateRequest{ImageName: imageName, StartCommand: startCommand}
+func (s *Service) CreateContainer(template ServiceTemplate) (Container, error) {
+	var newContainer Container
 
-	sandboxCreateRequestJson, err := json.Marshal(sandboxCreateRequest)
+	// The container's secrets and volumes must outlive it being saved
+	releaseSecrets, err := secretHandler.pin(template.Secrets)
 	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
 		return newContainer, err
 	}
-
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/api/sandboxes", server.IP), bytes.NewBuffer(sandboxCreateRequestJson))
+	defer releaseSecrets()
+	releaseVolumes, err := volumeHandler.pin(template.Mounts)
 	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
 		return newContainer, err
 	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	defer releaseVolumes()
+	env, err := template.environment()
 	if err != nil {
-		log.Fatalf("Error making request: %v", err)
 		return newContainer, err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	resources := scheduler.withDefaults(template.Resources)
+	server, release, mounts, err := volumeHandler.place(template.Mounts, resources)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
 		return newContainer, err
 	}
+	defer release()
 
-	var sandbox Sandbox
-	err = json.Unmarshal(body, &sandbox)
+	sandboxCreateRequest := SandboxCreateRequest{ImageName: template.ImageName, StartCommand: template.StartCommand, Resources: resources, Env: env, Mounts: mounts}
+	sandbox, err := sandboxClient.CreateSandbox(server.IP, sandboxCreateRequest)
 	if err != nil {
-		log.Fatalf("error unmarshalling JSON: %v", err)
 		return newContainer, err
 	}
 
@@ -78,47 +81,30 @@ func (s *Service) CreateContainer(imageName string, startCommand string) (Contai
 		return newContainer, err
 	}
 
-	newContainer = Container{ID: containerID, ServiceID: s.ID, ServerID: server.ID, SandboxID: sandbox.ID, Host: sandbox.PreviewURL, Status: sandbox.Status, ImageName: imageName, StartCommand: startCommand}
+	newContainer = Container{ID: containerID, ServiceID: s.ID, ServerID: server.ID, SandboxID: sandbox.ID, Host: sandbox.PreviewURL, Status: sandbox.Status, ImageName: template.ImageName, StartCommand: template.StartCommand, Resources: resources, Env: template.Env, Secrets: template.Secrets, Mounts: template.Mounts, CreatedAt: time.Now().UTC()}
 	s.Containers[containerID] = newContainer
+	if err := serviceHandler.SaveService(*s); err != nil {
+		delete(s.Containers, containerID)
+		sandboxClient.DeleteSandbox(server.IP, sandbox.ID)
+		return Container{}, err
+	}
 
 	return newContainer, nil
 }
 
+// template is what the container was created from, for recreating it as it
+// is.
+func (c Container) template() ServiceTemplate {
+	return ServiceTemplate{ImageName: c.ImageName, StartCommand: c.StartCommand, Resources: c.Resources, Env: c.Env, Secrets: c.Secrets, Mounts: c.Mounts}
+}
+
 func (s *Service) ListContainers() ([]Container, error) {
 	containers := make([]Container, 0, len(s.Containers))
 	for _, container := range s.Containers {
-		server, err := serverHandler.GetServer(container.ServerID)
-		if err != nil {
-			return containers, err
-		}
-		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/sandboxes/%s", server.IP, container.SandboxID), nil)
+		container, err := s.refreshContainer(container)
 		if err != nil {
-			log.Fatalf("Error creating request: %v", err)
 			return containers, err
 		}
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Fatalf("Error making request: %v", err)
-			return containers, err
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("Error reading response body: %v", err)
-			return containers, err
-		}
-
-		var sandbox Sandbox
-		err = json.Unmarshal(body, &sandbox)
-		if err != nil {
-			log.Fatalf("error unmarshalling JSON: %v", err)
-			return containers, err
-		}
-		container.Status = sandbox.Status
-	
 		containers = append(containers, container)
 	}
 
@@ -127,40 +113,157 @@ func (s *Service) ListContainers() ([]Container, error) {
 
 func (s *Service) GetContainer(ID string) (Container, error) {
 	container, ok := s.Containers[ID]
-	if ok {
-		return container, errors.New(fmt.Sprintf("Container not found with ID: %s", ID))
+	if !ok {
+		return container, NotFoundError("Container not found with ID: %s", ID)
+	}
+	return s.refreshContainer(container)
+}
+
+// refreshContainer fills in the container's current status from its agent.
+// Lost containers are reported as they are, their agent can't be asked.
+func (s *Service) refreshContainer(container Container) (Container, error) {
+	if container.Status == containerLost {
+		return container, nil
 	}
 	server, err := serverHandler.GetServer(container.ServerID)
 	if err != nil {
 		return container, err
 	}
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/sandboxes/%s", server.IP, container.SandboxID), nil)
+	sandbox, err := sandboxClient.GetSandbox(server.IP, container.SandboxID)
 	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
 		return container, err
 	}
+	container.Status = sandbox.Status
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Error making request: %v", err)
-		return container, err
-	}
-	defer resp.Body.Close()
+	return container, nil
+}
+
+// StopContainer, StartContainer and RestartContainer ask the sandbox agent on
+// the container's server to perform the action and record the new status.
+func (s *Service) StopContainer(ID string) (Container, error) {
+	return s.containerAction(ID, sandboxClient.StopSandbox)
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (s *Service) StartContainer(ID string) (Container, error) {
+	return s.containerAction(ID, sandboxClient.StartSandbox)
+}
+
+func (s *Service) RestartContainer(ID string) (Container, error) {
+	return s.containerAction(ID, sandboxClient.RestartSandbox)
+}
+
+func (s *Service) containerAction(ID string, action func(host string, ID string) (Sandbox, error)) (Container, error) {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return container, NotFoundError("Container not found with ID: %s", ID)
+	}
+	server, err := serverHandler.GetServer(container.ServerID)
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
 		return container, err
 	}
 
-	var sandbox Sandbox
-	err = json.Unmarshal(body, &sandbox)
+	sandbox, err := action(server.IP, container.SandboxID)
 	if err != nil {
-		log.Fatalf("error unmarshalling JSON: %v", err)
 		return container, err
 	}
 	container.Status = sandbox.Status
+	s.Containers[ID] = container
+	if err := serviceHandler.SaveService(*s); err != nil {
+		return container, err
+	}
 
 	return container, nil
 }
+
+// DeleteContainer tears down the container's sandbox on its server before
+// forgetting about it. A sandbox the agent no longer knows about counts as
+// already deleted, and a lost container is forgotten even if its agent can't
+// be reached.
+func (s *Service) DeleteContainer(ID string) error {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return NotFoundError("Container not found with ID: %s", ID)
+	}
+	server, err := serverHandler.GetServer(container.ServerID)
+	if err == nil {
+		err = sandboxClient.DeleteSandbox(server.IP, container.SandboxID)
+		if err != nil && !errors.Is(err, errSandboxNotFound) && container.Status != containerLost {
+			return err
+		}
+	}
+
+	delete(s.Containers, ID)
+	if err := serviceHandler.SaveService(*s); err != nil {
+		s.Containers[ID] = container
+		return err
+	}
+
+	return nil
+}
+
+// MoveContainer recreates a container wherever the scheduler places it and
+// only then stops and removes the original, so the service never runs short.
+func (s *Service) MoveContainer(ID string) (Container, error) {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return container, NotFoundError("Container not found with ID: %s", ID)
+	}
+	return s.replaceContainer(container, container.template())
+}
+
+// RedeployContainer replaces a container with one built from the service's
+// current template.
+func (s *Service) RedeployContainer(ID string) (Container, error) {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return container, NotFoundError("Container not found with ID: %s", ID)
+	}
+	return s.replaceContainer(container, s.ServiceTemplate)
+}
+
+// replaceContainer creates the replacement before removing the original, so
+// the service never runs short of a container.
+func (s *Service) replaceContainer(container Container, template ServiceTemplate) (Container, error) {
+	ID := container.ID
+	replacement, err := s.CreateContainer(template)
+	if err != nil {
+		return replacement, err
+	}
+
+	server, err := serverHandler.GetServer(container.ServerID)
+	if err == nil {
+		_, err = sandboxClient.StopSandbox(server.IP, container.SandboxID)
+		if err != nil && !IsNotFound(err) {
+			return replacement, err
+		}
+	}
+	if err := s.DeleteContainer(ID); err != nil {
+		return replacement, err
+	}
+
+	return replacement, nil
+}
+
+func (s *Service) ContainerLogs(ID string) (string, error) {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return "", NotFoundError("Container not found with ID: %s", ID)
+	}
+	server, err := serverHandler.GetServer(container.ServerID)
+	if err != nil {
+		return "", err
+	}
+	return sandboxClient.SandboxLogs(server.IP, container.SandboxID)
+}
+
+func (s *Service) ExecContainer(ID string, command string) (SandboxExecResult, error) {
+	container, ok := s.Containers[ID]
+	if !ok {
+		return SandboxExecResult{}, NotFoundError("Container not found with ID: %s", ID)
+	}
+	server, err := serverHandler.GetServer(container.ServerID)
+	if err != nil {
+		return SandboxExecResult{}, err
+	}
+	return sandboxClient.ExecSandbox(server.IP, container.SandboxID, SandboxExecRequest{Command: command})
+}
@@ -1,44 +1,97 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"sync"
 )
 
+// ServiceHandler is shared by every request goroutine. mu guards Services,
+// which only ever hands out clones so callers never share a Containers map.
+// Anything that changes a service's containers must hold that service's
+// lock (see lockService) for the whole read-modify-write.
 type ServiceHandler struct {
+	mu sync.RWMutex
 	Services map[string]Service
+	serviceLocks map[string]*sync.Mutex
+	store Store
 }
 
-func NewServiceHandler() *ServiceHandler {
-    return &ServiceHandler{
-        Services: make(map[string]Service),
-    }
+func NewServiceHandler(store Store) (*ServiceHandler, error) {
+	services := make(map[string]Service)
+	storedServices, err := store.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range storedServices {
+		if service.Containers == nil {
+			service.Containers = make(map[string]Container)
+		}
+		services[service.ID] = service
+	}
+
+	return &ServiceHandler{
+		Services: services,
+		serviceLocks: make(map[string]*sync.Mutex),
+		store: store,
+	}, nil
 }
 
 func (s *ServiceHandler) GetService(ID string) (Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	service, ok := s.Services[ID]
 	if !ok {
-		return service, errors.New(fmt.Sprintf("Service not found with ID '%s'", ID))
+		return service, NotFoundError("Service not found with ID '%s'", ID)
 	}
-	return service, nil
+	return service.clone(), nil
 }
 
 func (s *ServiceHandler) ListServices() ([]Service, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	services := make([]Service, 0, len(s.Services))
 	for _, service := range s.Services {
-		services = append(services, service)
+		services = append(services, service.clone())
 	}
 
 	return services, nil
 }
 
-func (s *ServiceHandler) CreateService(name string) (Service, error) {
+func (s *ServiceHandler) CreateService(name string, template ServiceTemplate, replicas int) (Service, error) {
 	var newService Service
+	if replicas < 0 {
+		return newService, ValidationError("Replicas must not be negative")
+	}
+	if replicas > 0 && template.ImageName == "" {
+		return newService, ValidationError("A service needs an image_name before it can have replicas")
+	}
+	if err := template.Resources.Validate(); err != nil {
+		return newService, err
+	}
+	if err := validateEnv(template.Env, template.Secrets); err != nil {
+		return newService, err
+	}
+	releaseSecrets, err := secretHandler.pin(template.Secrets)
+	if err != nil {
+		return newService, err
+	}
+	defer releaseSecrets()
+	if err := volumeHandler.validateMounts(template.Mounts); err != nil {
+		return newService, err
+	}
+	releaseVolumes, err := volumeHandler.pin(template.Mounts)
+	if err != nil {
+		return newService, err
+	}
+	defer releaseVolumes()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, service := range s.Services {
 		if service.Name == name {
-			return newService, errors.New(fmt.Sprintf("A service already exists with the name '%s'", name))
+			return newService, ConflictError("A service already exists with the name '%s'", name)
 		}
 	}
 
@@ -46,23 +99,320 @@ func (s *ServiceHandler) CreateService(name string) (Service, error) {
 	if err != nil {
 		return newService, err
 	}
-	newService = Service{ID: serviceID, Name: name, Containers: make(map[string]Container)}
+	newService = Service{ID: serviceID, Name: name, ServiceTemplate: template, Replicas: replicas, Containers: make(map[string]Container)}
+	if err := s.store.SaveService(newService); err != nil {
+		return Service{}, err
+	}
 	s.Services[serviceID] = newService
 
-	return newService, nil
+	return newService.clone(), nil
 }
 
+// DeleteService tears down the service's containers, as scaling it to zero
+// would, before forgetting the service. If a sandbox can't be deleted the
+// service is kept, with the containers that are left, so the delete can be
+// retried.
 func (s *ServiceHandler) DeleteService(ID string) error {
-	service, ok := s.Services[ID]
-	if !ok {
-		return errors.New(fmt.Sprintf("Service not found with ID '%s'", ID))
+	unlock := s.lockService(ID)
+	defer unlock()
+
+	service, err := s.GetService(ID)
+	if err != nil {
+		return err
+	}
+	for _, container := range service.containersByAge() {
+		if err := service.DeleteContainer(container.ID); err != nil {
+			return err
+		}
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.store.DeleteService(service.ID); err != nil {
+		return err
+	}
 	delete(s.Services, service.ID)
 
 	return nil
 }
 
+func (s *ServiceHandler) UpdateService(ID string, update ServiceUpdateRequest) (Service, error) {
+	unlock := s.lockService(ID)
+	defer unlock()
+
+	service, err := s.GetService(ID)
+	if err != nil {
+		return service, err
+	}
+	if update.ImageName != nil {
+		service.ImageName = *update.ImageName
+	}
+	if update.StartCommand != nil {
+		service.StartCommand = *update.StartCommand
+	}
+	if update.Resources != nil {
+		if err := update.Resources.Validate(); err != nil {
+			return Service{}, err
+		}
+		service.Resources = *update.Resources
+	}
+	if update.Env != nil {
+		service.Env = *update.Env
+	}
+	if update.Secrets != nil {
+		service.Secrets = *update.Secrets
+	}
+	if err := validateEnv(service.Env, service.Secrets); err != nil {
+		return Service{}, err
+	}
+	releaseSecrets, err := secretHandler.pin(service.Secrets)
+	if err != nil {
+		return Service{}, err
+	}
+	defer releaseSecrets()
+	if update.Mounts != nil {
+		service.Mounts = *update.Mounts
+	}
+	if err := volumeHandler.validateMounts(service.Mounts); err != nil {
+		return Service{}, err
+	}
+	releaseVolumes, err := volumeHandler.pin(service.Mounts)
+	if err != nil {
+		return Service{}, err
+	}
+	defer releaseVolumes()
+	if update.Replicas != nil {
+		service.Replicas = *update.Replicas
+	}
+	if service.Replicas < 0 {
+		return Service{}, ValidationError("Replicas must not be negative")
+	}
+	if service.Replicas > 0 && !service.Managed() {
+		return Service{}, ValidationError("A service needs an image_name before it can have replicas")
+	}
+
+	if err := s.SaveService(service); err != nil {
+		return Service{}, err
+	}
+	return service, nil
+}
+
+// ScaleService sets the service's replicas and creates or removes containers
+// right away, returning the resulting containers. policy picks which
+// containers go when scaling down.
+func (s *ServiceHandler) ScaleService(ID string, replicas int, policy string) ([]Container, error) {
+	unlock := s.lockService(ID)
+	defer unlock()
+
+	service, err := s.GetService(ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := service.validateScale(replicas, policy); err != nil {
+		return nil, err
+	}
+	if policy == "" {
+		policy = scaleDownNewest
+	}
+
+	service.Replicas = replicas
+	if err := s.SaveService(service); err != nil {
+		return nil, err
+	}
+	if err := service.scale(policy); err != nil {
+		return nil, err
+	}
+	return service.containersByAge(), nil
+}
+
+// validateScale checks a scale request up front, so the API can reject it
+// before starting an operation. An empty policy means scaleDownNewest.
+func (s Service) validateScale(replicas int, policy string) error {
+	if replicas < 0 {
+		return ValidationError("Replicas must not be negative")
+	}
+	if !s.Managed() {
+		return ValidationError("A service needs an image_name before it can be scaled")
+	}
+	if _, ok := scaleDownPolicies[policy]; policy != "" && !ok {
+		return ValidationError("Unknown scale down policy '%s'", policy)
+	}
+	return nil
+}
+
+// ReconcileService converges one service towards its desired replicas.
+func (s *ServiceHandler) ReconcileService(ID string) error {
+	unlock := s.lockService(ID)
+	defer unlock()
+
+	service, err := s.GetService(ID)
+	if err != nil {
+		return err
+	}
+	return service.reconcile()
+}
+
+// SaveService persists changes made to a service, such as its containers.
+// Callers must hold the service's lock.
+func (s *ServiceHandler) SaveService(service Service) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Services[service.ID]; !ok {
+		return NotFoundError("Service not found with ID '%s'", service.ID)
+	}
+	if err := s.store.SaveService(service); err != nil {
+		return err
+	}
+	s.Services[service.ID] = service.clone()
+
+	return nil
+}
+
+// CreateContainer creates a container from template, whose environment and
+// mounts are layered over the service's.
+func (s *ServiceHandler) CreateContainer(serviceID string, template ServiceTemplate) (Container, error) {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return Container{}, err
+	}
+	return service.CreateContainer(service.ServiceTemplate.withOverrides(template))
+}
+
+func (s *ServiceHandler) DeleteContainer(serviceID string, containerID string) error {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return err
+	}
+	return service.DeleteContainer(containerID)
+}
+
+func (s *ServiceHandler) MoveContainer(serviceID string, containerID string) (Container, error) {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return Container{}, err
+	}
+	return service.MoveContainer(containerID)
+}
+
+// DeployService rolls the service's containers onto its current template one
+// at a time, oldest first, returning the new containers.
+func (s *ServiceHandler) DeployService(ctx context.Context, ID string, run *OperationRun) ([]Container, error) {
+	service, err := s.GetService(ID)
+	if err != nil {
+		return nil, err
+	}
+	if !service.Managed() {
+		return nil, ValidationError("A service needs an image_name before it can be deployed")
+	}
+
+	containers := service.containersByAge()
+	deployed := []Container{}
+	for i, container := range containers {
+		if err := ctx.Err(); err != nil {
+			return deployed, err
+		}
+		run.Step(100*i/len(containers), "Replacing container '%s'", container.ID)
+		replacement, err := s.redeployContainer(ID, container.ID)
+		if IsNotFound(err) {
+			// Removed while we were deploying
+			continue
+		}
+		if err != nil {
+			return deployed, err
+		}
+		deployed = append(deployed, replacement)
+	}
+
+	return deployed, nil
+}
+
+func (s *ServiceHandler) redeployContainer(serviceID string, containerID string) (Container, error) {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return Container{}, err
+	}
+	return service.RedeployContainer(containerID)
+}
+
+// ContainerAction runs one of "stop", "start" or "restart" on a container.
+func (s *ServiceHandler) ContainerAction(serviceID string, containerID string, action string) (Container, error) {
+	unlock := s.lockService(serviceID)
+	defer unlock()
+
+	service, err := s.GetService(serviceID)
+	if err != nil {
+		return Container{}, err
+	}
+	switch action {
+	case "stop":
+		return service.StopContainer(containerID)
+	case "start":
+		return service.StartContainer(containerID)
+	case "restart":
+		return service.RestartContainer(containerID)
+	}
+	return Container{}, ValidationError("Unknown container action '%s'", action)
+}
+
+// ListServerContainers returns every container placed on the given server,
+// across all services.
+func (s *ServiceHandler) ListServerContainers(serverID string) ([]Container, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	containers := []Container{}
+	for _, service := range s.Services {
+		for _, container := range service.Containers {
+			if container.ServerID == serverID {
+				containers = append(containers, container)
+			}
+		}
+	}
+
+	return containers, nil
+}
+
+func (s *ServiceHandler) ListAllContainers() ([]Container, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	containers := []Container{}
+	for _, service := range s.Services {
+		for _, container := range service.Containers {
+			containers = append(containers, container)
+		}
+	}
+
+	return containers, nil
+}
+
+// lockService serializes changes to a single service's containers without
+// blocking requests for other services. It returns the unlock function.
+// Locks are kept after their service is deleted: a request already waiting on
+// one must still exclude whoever comes next.
+func (s *ServiceHandler) lockService(ID string) func() {
+	s.mu.Lock()
+	lock, ok := s.serviceLocks[ID]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.serviceLocks[ID] = lock
+	}
+	s.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
 func randomHex(n int) (string, error) {
 	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
@@ -82,6 +432,4 @@ func (s *ServiceHandler) generateId() (string, error) {
 			return id, nil
 		}
 	}
-
-	return "", fmt.Errorf("Could not generate service ID")
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentCreateContainerKeepsEveryContainer(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const creates = 8
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Containers) != creates {
+		t.Errorf("service has %d containers, want %d", len(service.Containers), creates)
+	}
+	if count := fake.sandboxCount(); count != creates {
+		t.Errorf("agents have %d sandboxes, want %d", count, creates)
+	}
+}
+
+func TestConcurrentScaleConverges(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, replicas := range []int{4, 1, 6, 0, 3, 5, 2} {
+		wg.Add(1)
+		go func(replicas int) {
+			defer wg.Done()
+			if _, err := serviceHandler.ScaleService(service.ID, replicas, ""); err != nil {
+				t.Error(err)
+			}
+		}(replicas)
+	}
+	wg.Wait()
+
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Containers) != service.Replicas {
+		t.Errorf("service has %d containers for %d replicas", len(service.Containers), service.Replicas)
+	}
+	if count := fake.sandboxCount(); count != service.Replicas {
+		t.Errorf("agents have %d sandboxes for %d replicas", count, service.Replicas)
+	}
+}
+
+func TestDeleteServiceRacingCreates(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceHandler.lockService(service.ID)()
+	lock := serviceHandler.serviceLocks[service.ID]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{}); err != nil && !IsNotFound(err) {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := serviceHandler.DeleteService(service.ID); err != nil && !IsNotFound(err) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := serviceHandler.GetService(service.ID); !IsNotFound(err) {
+		t.Fatalf("service still there after delete: %v", err)
+	}
+	// Requests that were already waiting on the old lock must still exclude
+	// the ones that come after the delete
+	if serviceHandler.serviceLocks[service.ID] != lock {
+		t.Error("deleting the service replaced its lock")
+	}
+	if count := fake.sandboxCount(); count != 0 {
+		t.Errorf("agents still have %d sandboxes of the deleted service", count)
+	}
+}
+
+func TestDeleteServiceDeletesSandboxes(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceHandler.ScaleService(service.ID, 3, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serviceHandler.DeleteService(service.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count := fake.sandboxCount(); count != 0 {
+		t.Errorf("agents still have %d sandboxes of the deleted service", count)
+	}
+}
+
+func TestCreateServiceRejectsReservedEnv(t *testing.T) {
+	newTestCluster(t)
+	for _, name := range []string{"PORT", "DOCKER_HOST", "DOCKER_CONFIG"} {
+		template := ServiceTemplate{ImageName: "nginx", Env: map[string]string{name: "x"}}
+		if _, err := serviceHandler.CreateService("web", template, 0); KindOf(err) != ErrValidation {
+			t.Errorf("creating a service setting %s: %v, want a validation error", name, err)
+		}
+	}
+	template := ServiceTemplate{ImageName: "nginx", Env: map[string]string{"MY_DOCKER_HOST": "x"}}
+	if _, err := serviceHandler.CreateService("web", template, 0); err != nil {
+		t.Errorf("creating a service setting MY_DOCKER_HOST: %v", err)
+	}
+}
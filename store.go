@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store persists the control plane's state so services, their containers and
+// the servers we provisioned survive a restart.
+type Store interface {
+	ListServices() ([]Service, error)
+	SaveService(service Service) error
+	DeleteService(ID string) error
+	ListServers() ([]Server, error)
+	SaveServer(server Server) error
+	DeleteServer(ID string) error
+	ListOperations() ([]Operation, error)
+	SaveOperation(operation Operation) error
+	// DeleteOperations deletes many operations at once, as they are pruned.
+	DeleteOperations(IDs []string) error
+	ListSecrets() ([]StoredSecret, error)
+	SaveSecret(secret StoredSecret) error
+	DeleteSecret(name string) error
+	ListVolumes() ([]Volume, error)
+	SaveVolume(volume Volume) error
+	DeleteVolume(ID string) error
+}
+
+func NewStore(kind string, path string) (Store, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file", "":
+		return NewFileStore(path)
+	}
+	return nil, fmt.Errorf("Unknown store type '%s'", kind)
+}
+
+// storeData is the on-disk layout of the file store. Version is the number of
+// migrations that have been applied to it.
+type storeData struct {
+	Version    int                  `json:"version"`
+	Services   map[string]Service   `json:"services"`
+	Servers    map[string]Server    `json:"servers"`
+	Operations map[string]Operation `json:"operations"`
+	// Secrets are keyed by name and hold only encrypted values.
+	Secrets map[string]StoredSecret `json:"secrets"`
+	Volumes map[string]Volume       `json:"volumes"`
+}
+
+// storeMigrations upgrade storeData one version at a time; migration i takes
+// the data from version i to version i+1. Only ever append to this list.
+var storeMigrations = []func(data *storeData) error{
+	func(data *storeData) error {
+		if data.Services == nil {
+			data.Services = make(map[string]Service)
+		}
+		if data.Servers == nil {
+			data.Servers = make(map[string]Server)
+		}
+		return nil
+	},
+	func(data *storeData) error {
+		if data.Operations == nil {
+			data.Operations = make(map[string]Operation)
+		}
+		return nil
+	},
+	func(data *storeData) error {
+		if data.Secrets == nil {
+			data.Secrets = make(map[string]StoredSecret)
+		}
+		return nil
+	},
+	func(data *storeData) error {
+		if data.Volumes == nil {
+			data.Volumes = make(map[string]Volume)
+		}
+		return nil
+	},
+}
+
+func (d *storeData) migrate() error {
+	if d.Version > len(storeMigrations) {
+		return fmt.Errorf("Store version %d is newer than this binary supports (%d)", d.Version, len(storeMigrations))
+	}
+	for d.Version < len(storeMigrations) {
+		if err := storeMigrations[d.Version](d); err != nil {
+			return fmt.Errorf("Store migration to version %d failed: %v", d.Version+1, err)
+		}
+		d.Version++
+	}
+	return nil
+}
+
+type MemoryStore struct {
+	mu   sync.Mutex
+	data storeData
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := &MemoryStore{}
+	store.data.migrate()
+	return store
+}
+
+func (m *MemoryStore) ListServices() ([]Service, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.listServices(), nil
+}
+
+func (m *MemoryStore) SaveService(service Service) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Services[service.ID] = service.clone()
+	return nil
+}
+
+func (m *MemoryStore) DeleteService(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data.Services, ID)
+	return nil
+}
+
+func (m *MemoryStore) ListServers() ([]Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.listServers(), nil
+}
+
+func (m *MemoryStore) SaveServer(server Server) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Servers[server.ID] = server
+	return nil
+}
+
+func (m *MemoryStore) DeleteServer(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data.Servers, ID)
+	return nil
+}
+
+func (m *MemoryStore) ListOperations() ([]Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.listOperations(), nil
+}
+
+func (m *MemoryStore) SaveOperation(operation Operation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Operations[operation.ID] = operation.clone()
+	return nil
+}
+
+func (m *MemoryStore) DeleteOperations(IDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ID := range IDs {
+		delete(m.data.Operations, ID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListSecrets() ([]StoredSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.listSecrets(), nil
+}
+
+func (m *MemoryStore) SaveSecret(secret StoredSecret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Secrets[secret.Name] = secret
+	return nil
+}
+
+func (m *MemoryStore) DeleteSecret(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data.Secrets, name)
+	return nil
+}
+
+func (m *MemoryStore) ListVolumes() ([]Volume, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.listVolumes(), nil
+}
+
+func (m *MemoryStore) SaveVolume(volume Volume) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.Volumes[volume.ID] = volume
+	return nil
+}
+
+func (m *MemoryStore) DeleteVolume(ID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data.Volumes, ID)
+	return nil
+}
+
+// FileStore keeps the whole state in a single JSON file. Every write replaces
+// the file atomically, so a crash mid-write leaves the previous state intact.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	data storeData
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{path: path}
+
+	contents, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Error reading store file '%s': %v", path, err)
+	}
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &store.data); err != nil {
+			return nil, fmt.Errorf("Error parsing store file '%s': %v", path, err)
+		}
+	}
+
+	version := store.data.Version
+	if err := store.data.migrate(); err != nil {
+		return nil, err
+	}
+	if version != store.data.Version {
+		if err := store.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (f *FileStore) ListServices() ([]Service, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.listServices(), nil
+}
+
+func (f *FileStore) SaveService(service Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Services[service.ID]
+	f.data.Services[service.ID] = service.clone()
+	if err := f.flush(); err != nil {
+		if existed {
+			f.data.Services[service.ID] = previous
+		} else {
+			delete(f.data.Services, service.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) DeleteService(ID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Services[ID]
+	if !existed {
+		return nil
+	}
+	delete(f.data.Services, ID)
+	if err := f.flush(); err != nil {
+		f.data.Services[ID] = previous
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) ListServers() ([]Server, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.listServers(), nil
+}
+
+func (f *FileStore) SaveServer(server Server) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Servers[server.ID]
+	f.data.Servers[server.ID] = server
+	if err := f.flush(); err != nil {
+		if existed {
+			f.data.Servers[server.ID] = previous
+		} else {
+			delete(f.data.Servers, server.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) DeleteServer(ID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Servers[ID]
+	if !existed {
+		return nil
+	}
+	delete(f.data.Servers, ID)
+	if err := f.flush(); err != nil {
+		f.data.Servers[ID] = previous
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) ListOperations() ([]Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.listOperations(), nil
+}
+
+func (f *FileStore) SaveOperation(operation Operation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Operations[operation.ID]
+	f.data.Operations[operation.ID] = operation.clone()
+	if err := f.flush(); err != nil {
+		if existed {
+			f.data.Operations[operation.ID] = previous
+		} else {
+			delete(f.data.Operations, operation.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) DeleteOperations(IDs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous := make(map[string]Operation, len(IDs))
+	for _, ID := range IDs {
+		if operation, ok := f.data.Operations[ID]; ok {
+			previous[ID] = operation
+			delete(f.data.Operations, ID)
+		}
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+	if err := f.flush(); err != nil {
+		for ID, operation := range previous {
+			f.data.Operations[ID] = operation
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) ListSecrets() ([]StoredSecret, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.listSecrets(), nil
+}
+
+func (f *FileStore) SaveSecret(secret StoredSecret) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Secrets[secret.Name]
+	f.data.Secrets[secret.Name] = secret
+	if err := f.flush(); err != nil {
+		if existed {
+			f.data.Secrets[secret.Name] = previous
+		} else {
+			delete(f.data.Secrets, secret.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) DeleteSecret(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Secrets[name]
+	if !existed {
+		return nil
+	}
+	delete(f.data.Secrets, name)
+	if err := f.flush(); err != nil {
+		f.data.Secrets[name] = previous
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) ListVolumes() ([]Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.listVolumes(), nil
+}
+
+func (f *FileStore) SaveVolume(volume Volume) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Volumes[volume.ID]
+	f.data.Volumes[volume.ID] = volume
+	if err := f.flush(); err != nil {
+		if existed {
+			f.data.Volumes[volume.ID] = previous
+		} else {
+			delete(f.data.Volumes, volume.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) DeleteVolume(ID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous, existed := f.data.Volumes[ID]
+	if !existed {
+		return nil
+	}
+	delete(f.data.Volumes, ID)
+	if err := f.flush(); err != nil {
+		f.data.Volumes[ID] = previous
+		return err
+	}
+	return nil
+}
+
+// flush writes the state to a temporary file next to the store and renames it
+// over the real one. Callers must hold f.mu.
+func (f *FileStore) flush() error {
+	contents, err := json.MarshalIndent(f.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding store: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary store file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing store file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error syncing store file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing store file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("Error replacing store file: %v", err)
+	}
+	return nil
+}
+
+func (d *storeData) listServices() []Service {
+	services := make([]Service, 0, len(d.Services))
+	for _, service := range d.Services {
+		services = append(services, service.clone())
+	}
+	return services
+}
+
+func (d *storeData) listServers() []Server {
+	servers := make([]Server, 0, len(d.Servers))
+	for _, server := range d.Servers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func (d *storeData) listOperations() []Operation {
+	operations := make([]Operation, 0, len(d.Operations))
+	for _, operation := range d.Operations {
+		operations = append(operations, operation.clone())
+	}
+	return operations
+}
+
+func (d *storeData) listSecrets() []StoredSecret {
+	secrets := make([]StoredSecret, 0, len(d.Secrets))
+	for _, secret := range d.Secrets {
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+func (d *storeData) listVolumes() []Volume {
+	volumes := make([]Volume, 0, len(d.Volumes))
+	for _, volume := range d.Volumes {
+		volumes = append(volumes, volume)
+	}
+	return volumes
+}
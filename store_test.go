@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreMigratesOldFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jcs.json")
+	// A store from before versions, operations, secrets and volumes
+	old := `{"services": {"abc": {"id": "abc", "name": "web", "image_name": "nginx", "containers": {}}}, "servers": {}}`
+	if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := store.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Name != "web" || services[0].ImageName != "nginx" {
+		t.Errorf("services = %+v, want the old file's service", services)
+	}
+	// Maps added by later migrations take writes
+	if err := store.SaveVolume(Volume{ID: "v1", Name: "data", Driver: "local"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveSecret(StoredSecret{Name: "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migrated file is written back with the current version
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var onDisk storeData
+	if err := json.Unmarshal(contents, &onDisk); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk.Version != len(storeMigrations) {
+		t.Errorf("file is at version %d, want %d", onDisk.Version, len(storeMigrations))
+	}
+}
+
+func TestFileStoreRefusesNewerFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jcs.json")
+	if err := os.WriteFile(path, []byte(`{"version": 999}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Error("opened a store written by a newer version")
+	}
+}
+
+func TestFileStorePersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jcs.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := Service{ID: "s1", Name: "web", ServiceTemplate: ServiceTemplate{ImageName: "nginx"}, Replicas: 1, Containers: map[string]Container{"c1": {ID: "c1", ServiceID: "s1", ServerID: "srv1"}}}
+	for _, err := range []error{
+		store.SaveService(service),
+		store.SaveService(Service{ID: "s2", Name: "gone", Containers: map[string]Container{}}),
+		store.DeleteService("s2"),
+		store.SaveServer(Server{ID: "srv1", Name: "jcs-a", Status: "running", Owned: true}),
+		store.SaveOperation(Operation{ID: "op1", Type: "service.scale", Status: OperationSucceeded}),
+		store.SaveOperation(Operation{ID: "op2", Type: "service.scale", Status: OperationFailed}),
+		store.DeleteOperations([]string{"op2"}),
+		store.SaveSecret(StoredSecret{Name: "token", Ciphertext: []byte("sealed")}),
+		store.SaveVolume(Volume{ID: "v1", Name: "data", Driver: "local", ServerID: "srv1"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, _ := reopened.ListServices()
+	if len(services) != 1 || services[0].Name != "web" || services[0].Containers["c1"].ServerID != "srv1" {
+		t.Errorf("services = %+v, want only 'web' with its container", services)
+	}
+	servers, _ := reopened.ListServers()
+	if len(servers) != 1 || !servers[0].Owned || servers[0].Status != "running" {
+		t.Errorf("servers = %+v", servers)
+	}
+	operations, _ := reopened.ListOperations()
+	if len(operations) != 1 || operations[0].ID != "op1" {
+		t.Errorf("operations = %+v, want only 'op1'", operations)
+	}
+	secrets, _ := reopened.ListSecrets()
+	if len(secrets) != 1 || string(secrets[0].Ciphertext) != "sealed" {
+		t.Errorf("secrets = %+v", secrets)
+	}
+	volumes, _ := reopened.ListVolumes()
+	if len(volumes) != 1 || volumes[0].ServerID != "srv1" {
+		t.Errorf("volumes = %+v", volumes)
+	}
+
+	// Writes go through a temporary file that is renamed over the store
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "jcs.json" {
+		t.Errorf("store directory holds %v, want only the store file", entries)
+	}
+}
+
+func TestFileStoreKeepsStateWhenAWriteFails(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jcs.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveService(Service{ID: "s1", Name: "web", Containers: map[string]Container{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its directory the temporary file can't be created
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveService(Service{ID: "s2", Name: "api", Containers: map[string]Container{}}); err == nil {
+		t.Fatal("saving without a store directory succeeded")
+	}
+	if err := store.DeleteService("s1"); err == nil {
+		t.Fatal("deleting without a store directory succeeded")
+	}
+	services, _ := store.ListServices()
+	if len(services) != 1 || services[0].ID != "s1" {
+		t.Errorf("services = %+v, want the state before the failed writes", services)
+	}
+}
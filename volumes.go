@@ -0,0 +1,633 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Volume is persistent storage containers mount by name. It lives on one
+// server at a time, and containers mounting it are placed there.
+type Volume struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	SizeGB int    `json:"size_gb"`
+	// ServerID is the server the volume is attached to, empty until a
+	// container first mounts it.
+	ServerID string `json:"server_id,omitempty"`
+	// RemoteID is the volume's ID at the provider, for drivers that have one.
+	RemoteID  string    `json:"remote_id,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	volumeDetached = "detached"
+	volumeAttached = "attached"
+)
+
+// VolumeMount mounts the volume with the given name at Path in a container.
+type VolumeMount struct {
+	Volume string `json:"volume"`
+	Path   string `json:"path"`
+}
+
+// SandboxMount is a mount as the sandbox agent sees it. HostPath is where
+// the volume is mounted on the server, or empty for the agent to keep the
+// volume in its own data directory.
+type SandboxMount struct {
+	Volume   string `json:"volume"`
+	HostPath string `json:"host_path,omitempty"`
+	Path     string `json:"path"`
+}
+
+type VolumeCreateRequest struct {
+	Name string `json:"name"`
+	// Driver defaults to "hetzner" with the hetzner provider and "local"
+	// otherwise.
+	Driver string `json:"driver,omitempty"`
+	SizeGB int    `json:"size_gb,omitempty"`
+}
+
+const defaultVolumeSizeGB = 10
+
+// Hetzner doesn't create volumes smaller than this.
+const hetznerMinVolumeSizeGB = 10
+
+var volumeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// VolumeDriver manages where a volume's data lives.
+type VolumeDriver interface {
+	// Attach makes the volume available on server, creating it first if it
+	// doesn't exist yet, and returns it updated.
+	Attach(volume Volume, server Server) (Volume, error)
+	// Detach frees the volume from its server so it can be attached to
+	// another.
+	Detach(volume Volume) (Volume, error)
+	Delete(volume Volume) error
+	// HostPath is where the volume is mounted on its server.
+	HostPath(volume Volume) string
+}
+
+// localVolumeDriver keeps a volume as a directory in the data directory of
+// the sandbox agent it is first used on. It can never leave that server.
+type localVolumeDriver struct{}
+
+func (localVolumeDriver) Attach(volume Volume, server Server) (Volume, error) {
+	volume.ServerID = server.ID
+	return volume, nil
+}
+
+func (localVolumeDriver) Detach(volume Volume) (Volume, error) {
+	return volume, ValidationError("Local volume '%s' lives on server '%s' and can't be detached", volume.Name, volume.ServerID)
+}
+
+func (localVolumeDriver) Delete(volume Volume) error {
+	if volume.ServerID == "" {
+		return nil
+	}
+	server, err := serverHandler.GetServer(volume.ServerID)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := sandboxClient.DeleteVolume(server.IP, volume.ID); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (localVolumeDriver) HostPath(volume Volume) string {
+	return ""
+}
+
+// hetznerVolumeDriver uses Hetzner Volumes, which Hetzner formats and mounts
+// on the server. A volume is only created at Hetzner when it is first
+// attached, so it lands in its server's location.
+type hetznerVolumeDriver struct {
+	config HetznerConfig
+	api    *HetznerApiClient
+}
+
+func (h hetznerVolumeDriver) Attach(volume Volume, server Server) (Volume, error) {
+	if server.Type != "hetzner" {
+		return volume, ValidationError("Hetzner volume '%s' can't be attached to %s server '%s'", volume.Name, server.Type, server.ID)
+	}
+	serverID, err := strconv.Atoi(server.RemoteID)
+	if err != nil {
+		return volume, newError(ErrInternal, err, "Server '%s' has an invalid Hetzner ID '%s'", server.ID, server.RemoteID)
+	}
+
+	if volume.RemoteID == "" {
+		created, err := h.api.CreateVolume(volume.Name, volume.SizeGB, serverID, true, "ext4")
+		if err != nil {
+			return volume, err
+		}
+		volume.RemoteID = strconv.Itoa(created.Volume.ID)
+		for _, action := range append([]HetznerAction{created.Action}, created.NextActions...) {
+			if err := waitForHetznerAction(h.api, h.config, action.ID, fmt.Sprintf("create volume %s", volume.RemoteID)); err != nil {
+				// Keep the remote ID so deleting the volume cleans it up
+				return volume, err
+			}
+		}
+	} else {
+		attached, err := h.api.AttachVolume(volume.RemoteID, serverID, true)
+		if err != nil {
+			return volume, err
+		}
+		if err := waitForHetznerAction(h.api, h.config, attached.Action.ID, fmt.Sprintf("attach volume %s", volume.RemoteID)); err != nil {
+			return volume, err
+		}
+	}
+	volume.ServerID = server.ID
+	return volume, nil
+}
+
+func (h hetznerVolumeDriver) Detach(volume Volume) (Volume, error) {
+	if volume.RemoteID != "" {
+		detached, err := h.api.DetachVolume(volume.RemoteID)
+		if err != nil && !IsNotFound(err) {
+			return volume, err
+		}
+		if err == nil {
+			if err := waitForHetznerAction(h.api, h.config, detached.Action.ID, fmt.Sprintf("detach volume %s", volume.RemoteID)); err != nil {
+				return volume, err
+			}
+		}
+	}
+	volume.ServerID = ""
+	return volume, nil
+}
+
+func (h hetznerVolumeDriver) Delete(volume Volume) error {
+	if volume.RemoteID == "" {
+		return nil
+	}
+	remote, err := h.api.GetVolume(volume.RemoteID)
+	if IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if remote.Volume.Server != nil {
+		if _, err := h.Detach(volume); err != nil {
+			return err
+		}
+	}
+	if err := h.api.DeleteVolume(volume.RemoteID); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (h hetznerVolumeDriver) HostPath(volume Volume) string {
+	return "/mnt/HC_Volume_" + volume.RemoteID
+}
+
+// VolumeHandler keeps the volumes and attaches them to servers as containers
+// are placed. attachMu serializes attaching and detaching, so a volume is
+// never attached to two servers at once. pins counts, by volume name, the
+// services and containers that checked a volume exists but haven't saved
+// their mount of it yet, and deleting holds the volumes DeleteVolume is
+// deleting, which can't be pinned.
+type VolumeHandler struct {
+	mu            sync.RWMutex
+	attachMu      sync.Mutex
+	volumes       map[string]Volume
+	pins          map[string]int
+	deleting      map[string]bool
+	store         Store
+	drivers       map[string]VolumeDriver
+	defaultDriver string
+}
+
+func NewVolumeHandler(store Store, config Config) (*VolumeHandler, error) {
+	storedVolumes, err := store.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	handler := &VolumeHandler{
+		volumes:       make(map[string]Volume),
+		pins:          make(map[string]int),
+		deleting:      make(map[string]bool),
+		store:         store,
+		drivers:       map[string]VolumeDriver{"local": localVolumeDriver{}},
+		defaultDriver: "local",
+	}
+	if config.Provider == "hetzner" {
+		api := NewHetznerApiClient(config.Hetzner.BaseURL, config.Hetzner.APIKey, &http.Client{Timeout: 30 * time.Second})
+		handler.drivers["hetzner"] = hetznerVolumeDriver{config: config.Hetzner, api: api}
+		handler.defaultDriver = "hetzner"
+	}
+	for _, volume := range storedVolumes {
+		handler.volumes[volume.ID] = volume
+	}
+	return handler, nil
+}
+
+func (h *VolumeHandler) ListVolumes() []Volume {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	volumes := make([]Volume, 0, len(h.volumes))
+	for _, volume := range h.volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes
+}
+
+func (h *VolumeHandler) GetVolume(ID string) (Volume, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	volume, ok := h.volumes[ID]
+	if !ok {
+		return volume, NotFoundError("Volume not found with ID '%s'", ID)
+	}
+	return volume, nil
+}
+
+// VolumeByName looks a volume up by the name containers mount it with.
+func (h *VolumeHandler) VolumeByName(name string) (Volume, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, volume := range h.volumes {
+		if volume.Name == name {
+			return volume, nil
+		}
+	}
+	return Volume{}, NotFoundError("Volume not found with name '%s'", name)
+}
+
+func (h *VolumeHandler) CreateVolume(request VolumeCreateRequest) (Volume, error) {
+	if !volumeNamePattern.MatchString(request.Name) {
+		return Volume{}, ValidationError("Volume name '%s' may only contain lowercase letters, digits and '-'", request.Name)
+	}
+	if request.Driver == "" {
+		request.Driver = h.defaultDriver
+	}
+	if _, ok := h.drivers[request.Driver]; !ok {
+		return Volume{}, ValidationError("Unknown volume driver '%s'", request.Driver)
+	}
+	if request.SizeGB == 0 {
+		request.SizeGB = defaultVolumeSizeGB
+	}
+	if request.SizeGB < 0 {
+		return Volume{}, ValidationError("Volume size must not be negative")
+	}
+	if request.Driver == "hetzner" && request.SizeGB < hetznerMinVolumeSizeGB {
+		return Volume{}, ValidationError("Hetzner volumes must be at least %dGB", hetznerMinVolumeSizeGB)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, volume := range h.volumes {
+		if volume.Name == request.Name {
+			return Volume{}, ConflictError("A volume already exists with the name '%s'", request.Name)
+		}
+	}
+	ID, err := h.generateId()
+	if err != nil {
+		return Volume{}, err
+	}
+	volume := Volume{ID: ID, Name: request.Name, Driver: request.Driver, SizeGB: request.SizeGB, Status: volumeDetached, CreatedAt: time.Now().UTC()}
+	if err := h.store.SaveVolume(volume); err != nil {
+		return Volume{}, err
+	}
+	h.volumes[ID] = volume
+	return volume, nil
+}
+
+// DeleteVolume deletes the volume and its data. It refuses while a service
+// or container still mounts the volume, or is about to.
+func (h *VolumeHandler) DeleteVolume(ID string) error {
+	h.attachMu.Lock()
+	defer h.attachMu.Unlock()
+	h.mu.Lock()
+	volume, ok := h.volumes[ID]
+	if !ok {
+		h.mu.Unlock()
+		return NotFoundError("Volume not found with ID '%s'", ID)
+	}
+	if h.pins[volume.Name] > 0 {
+		h.mu.Unlock()
+		return ConflictError("Volume '%s' is being mounted by a service or container that is being saved", volume.Name)
+	}
+	// From here on the volume can't be pinned, so a mount saved before
+	// shows up below and none is saved after
+	h.deleting[volume.Name] = true
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.deleting, volume.Name)
+	}()
+
+	if users := serviceHandler.volumeUsers(volume.Name, ""); len(users) > 0 {
+		return ConflictError("Volume '%s' is still mounted by %s", volume.Name, strings.Join(users, ", "))
+	}
+	if err := h.drivers[volume.Driver].Delete(volume); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.store.DeleteVolume(ID); err != nil {
+		return err
+	}
+	delete(h.volumes, ID)
+	return nil
+}
+
+// DetachVolume frees the volume from its server, so the next container that
+// mounts it can be placed anywhere. It refuses while containers on that
+// server still mount it.
+func (h *VolumeHandler) DetachVolume(ID string) (Volume, error) {
+	h.attachMu.Lock()
+	defer h.attachMu.Unlock()
+	volume, err := h.GetVolume(ID)
+	if err != nil {
+		return volume, err
+	}
+	if volume.ServerID == "" {
+		return volume, nil
+	}
+	if users := serviceHandler.volumeUsers(volume.Name, volume.ServerID); len(users) > 0 {
+		return volume, ConflictError("Volume '%s' is still mounted by %s", volume.Name, strings.Join(users, ", "))
+	}
+	return h.detachLocked(volume)
+}
+
+// validateMounts checks that mounted volumes exist and that no volume or path
+// is mounted twice.
+func (h *VolumeHandler) validateMounts(mounts []VolumeMount) error {
+	volumes := make(map[string]bool, len(mounts))
+	paths := make(map[string]bool, len(mounts))
+	for _, mount := range mounts {
+		if _, err := h.VolumeByName(mount.Volume); err != nil {
+			return ValidationError("Volume '%s' mounted at '%s' does not exist", mount.Volume, mount.Path)
+		}
+		if !path.IsAbs(mount.Path) || path.Clean(mount.Path) != mount.Path || mount.Path == "/" {
+			return ValidationError("Mount path '%s' must be a clean absolute path below '/'", mount.Path)
+		}
+		if volumes[mount.Volume] {
+			return ValidationError("Volume '%s' is mounted more than once", mount.Volume)
+		}
+		if paths[mount.Path] {
+			return ValidationError("More than one volume is mounted at '%s'", mount.Path)
+		}
+		volumes[mount.Volume] = true
+		paths[mount.Path] = true
+	}
+	return nil
+}
+
+// pin keeps the mounted volumes from being deleted until the returned
+// function is called, which callers do once the mounts are saved. It fails
+// if one of them doesn't exist or is being deleted.
+func (h *VolumeHandler) pin(mounts []VolumeMount) (func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make(map[string]bool, len(h.volumes))
+	for _, volume := range h.volumes {
+		names[volume.Name] = true
+	}
+	for _, mount := range mounts {
+		if !names[mount.Volume] {
+			return nil, ValidationError("Volume '%s' mounted at '%s' does not exist", mount.Volume, mount.Path)
+		}
+		if h.deleting[mount.Volume] {
+			return nil, ConflictError("Volume '%s' mounted at '%s' is being deleted", mount.Volume, mount.Path)
+		}
+	}
+	for _, mount := range mounts {
+		h.pins[mount.Volume]++
+	}
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, mount := range mounts {
+			if h.pins[mount.Volume]--; h.pins[mount.Volume] == 0 {
+				delete(h.pins, mount.Volume)
+			}
+		}
+	}, nil
+}
+
+// place has the scheduler place a container with the mounts and attaches its
+// volumes to the server it picked. The returned release function is the
+// scheduler's. With mounts, attachMu is held from finding the server the
+// volumes pin the container to until they are attached there, so another
+// container can't take the volumes elsewhere in between; that includes the
+// wait for a new server should one be needed.
+func (h *VolumeHandler) place(mounts []VolumeMount, resources Resources) (Server, func(), []SandboxMount, error) {
+	if len(mounts) > 0 {
+		h.attachMu.Lock()
+		defer h.attachMu.Unlock()
+	}
+	pinnedServerID, err := h.pinnedServerLocked(mounts)
+	if err != nil {
+		return Server{}, nil, nil, err
+	}
+	server, release, err := scheduler.Place(resources, pinnedServerID)
+	if err != nil {
+		return Server{}, nil, nil, err
+	}
+	sandboxMounts, err := h.attachLocked(mounts, server)
+	if err != nil {
+		release()
+		return Server{}, nil, nil, err
+	}
+	return server, release, sandboxMounts, nil
+}
+
+// pinnedServerLocked returns the server a container with the mounts has to
+// be placed on, or "" when none of its volumes is attached yet. A volume left
+// on a server that is gone or no longer takes containers is detached when no
+// container there still mounts it and its driver can move it, so the
+// container follows it to a new server. Callers hold attachMu.
+func (h *VolumeHandler) pinnedServerLocked(mounts []VolumeMount) (string, error) {
+	pinned, pinnedBy := "", ""
+	for _, mount := range mounts {
+		volume, err := h.VolumeByName(mount.Volume)
+		if err != nil {
+			return "", ValidationError("Volume '%s' mounted at '%s' does not exist", mount.Volume, mount.Path)
+		}
+		if volume.ServerID == "" {
+			continue
+		}
+		server, err := serverHandler.GetServer(volume.ServerID)
+		stranded := IsNotFound(err) || (err == nil && !server.Schedulable())
+		if stranded && len(serviceHandler.volumeUsers(volume.Name, volume.ServerID)) == 0 {
+			if _, err := h.detachLocked(volume); err == nil {
+				log.Printf("Detached volume '%s' from unavailable server '%s'", volume.Name, volume.ServerID)
+				continue
+			}
+		}
+		if pinned != "" && pinned != volume.ServerID {
+			return "", ConflictError("Volumes '%s' and '%s' are attached to different servers", pinnedBy, volume.Name)
+		}
+		pinned, pinnedBy = volume.ServerID, volume.Name
+	}
+	return pinned, nil
+}
+
+// attachLocked attaches the mounted volumes to server, where the container
+// was placed, and returns the mounts for its sandbox agent. Callers hold
+// attachMu.
+func (h *VolumeHandler) attachLocked(mounts []VolumeMount, server Server) ([]SandboxMount, error) {
+	sandboxMounts := make([]SandboxMount, 0, len(mounts))
+	for _, mount := range mounts {
+		volume, err := h.VolumeByName(mount.Volume)
+		if err != nil {
+			return nil, ValidationError("Volume '%s' mounted at '%s' does not exist", mount.Volume, mount.Path)
+		}
+		if volume.ServerID != "" && volume.ServerID != server.ID {
+			return nil, ConflictError("Volume '%s' is attached to server '%s'", volume.Name, volume.ServerID)
+		}
+		driver := h.drivers[volume.Driver]
+		if volume.ServerID == "" {
+			attached, err := driver.Attach(volume, server)
+			if attached.RemoteID != volume.RemoteID {
+				// Record the remote volume even when attaching failed, so
+				// it isn't created twice or leaked
+				created := volume
+				created.RemoteID = attached.RemoteID
+				if err := h.save(created); err != nil {
+					log.Printf("Error recording remote volume '%s' of volume '%s', it may need to be deleted by hand: %v", created.RemoteID, created.Name, err)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			attached.Status = volumeAttached
+			if err := h.save(attached); err != nil {
+				return nil, err
+			}
+			volume = attached
+		}
+		sandboxMounts = append(sandboxMounts, SandboxMount{Volume: volume.ID, HostPath: driver.HostPath(volume), Path: mount.Path})
+	}
+	return sandboxMounts, nil
+}
+
+// localVolumes lists the names of local volumes attached to the server,
+// whose data goes with it.
+func (h *VolumeHandler) localVolumes(serverID string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := []string{}
+	for _, volume := range h.volumes {
+		if volume.ServerID == serverID && volume.Driver == "local" {
+			names = append(names, volume.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// localMount returns the name of a local volume among the mounts, if any;
+// a container mounting one can't move to another server.
+func (h *VolumeHandler) localMount(mounts []VolumeMount) (string, bool) {
+	for _, mount := range mounts {
+		volume, err := h.VolumeByName(mount.Volume)
+		if err == nil && volume.Driver == "local" {
+			return volume.Name, true
+		}
+	}
+	return "", false
+}
+
+// serverDeleted marks the volumes that were attached to a deleted server as
+// detached; the provider detaches them along with the server.
+func (h *VolumeHandler) serverDeleted(serverID string) {
+	h.attachMu.Lock()
+	defer h.attachMu.Unlock()
+	for _, volume := range h.ListVolumes() {
+		if volume.ServerID == serverID {
+			volume.ServerID = ""
+			volume.Status = volumeDetached
+			if err := h.save(volume); err != nil {
+				log.Printf("Error detaching volume '%s' from deleted server '%s': %v", volume.Name, serverID, err)
+			}
+		}
+	}
+}
+
+// detachLocked detaches the volume through its driver. Callers hold
+// attachMu.
+func (h *VolumeHandler) detachLocked(volume Volume) (Volume, error) {
+	detached, err := h.drivers[volume.Driver].Detach(volume)
+	if err != nil {
+		return volume, err
+	}
+	detached.Status = volumeDetached
+	if err := h.save(detached); err != nil {
+		return volume, err
+	}
+	return detached, nil
+}
+
+func (h *VolumeHandler) save(volume Volume) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.store.SaveVolume(volume); err != nil {
+		return err
+	}
+	h.volumes[volume.ID] = volume
+	return nil
+}
+
+func (h *VolumeHandler) generateId() (string, error) {
+	for {
+		id, err := randomHex(3)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := h.volumes[id]; !ok {
+			return id, nil
+		}
+	}
+}
+
+// volumeUsers lists the services and containers that mount the volume. With
+// a serverID, only containers on that server that aren't lost count.
+func (s *ServiceHandler) volumeUsers(name string, serverID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := []string{}
+	for _, service := range s.Services {
+		if serverID == "" && mounts(service.Mounts, name) {
+			users = append(users, fmt.Sprintf("service '%s'", service.Name))
+		}
+		for _, container := range service.Containers {
+			if serverID != "" && (container.ServerID != serverID || container.Status == containerLost) {
+				continue
+			}
+			if mounts(container.Mounts, name) {
+				users = append(users, fmt.Sprintf("container '%s'", container.ID))
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+func mounts(volumeMounts []VolumeMount, name string) bool {
+	for _, mount := range volumeMounts {
+		if mount.Volume == name {
+			return true
+		}
+	}
+	return false
+}
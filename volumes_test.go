@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStrategy is a scheduling strategy that takes a while to pick a server,
+// leaving a gap between looking up where a container's volumes are and
+// attaching them.
+type slowStrategy struct {
+	SchedulingStrategy
+}
+
+func (s slowStrategy) Select(candidates []ServerLoad, request Resources) ServerLoad {
+	time.Sleep(20 * time.Millisecond)
+	return s.SchedulingStrategy.Select(candidates, request)
+}
+
+func TestContainersSharingANewVolumeLandTogether(t *testing.T) {
+	newTestCluster(t)
+	// Spread the containers out unless their volume holds them together
+	scheduler.strategy = slowStrategy{leastLoadedStrategy{}}
+	if _, err := serverHandler.CreateServer("jcs-b", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := volumeHandler.CreateVolume(VolumeCreateRequest{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each container is on its own service so nothing but the volume lock
+	// keeps them apart
+	template := ServiceTemplate{ImageName: "nginx", Mounts: []VolumeMount{{Volume: "data", Path: "/data"}}}
+	services := make([]Service, 4)
+	for i := range services {
+		var err error
+		if services[i], err = serviceHandler.CreateService(string(rune('a'+i)), template, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	containers := make([]Container, len(services))
+	var wg sync.WaitGroup
+	for i, service := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if containers[i], err = serviceHandler.CreateContainer(service.ID, ServiceTemplate{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	volume, err := volumeHandler.VolumeByName("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, container := range containers {
+		if container.ServerID != volume.ServerID {
+			t.Errorf("container '%s' is on server '%s', away from its volume on '%s'", container.ID, container.ServerID, volume.ServerID)
+		}
+	}
+}
+
+func TestDeleteVolumeRefusesWhileContainersAreCreated(t *testing.T) {
+	fake := newTestCluster(t)
+	service, err := serviceHandler.CreateService("web", ServiceTemplate{ImageName: "nginx"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume, err := volumeHandler.CreateVolume(VolumeCreateRequest{Name: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the volume while a container that mounts it is being created:
+	// it is attached but the container isn't saved yet
+	sandboxClient = slowCreates{fake, func() {
+		if err := volumeHandler.DeleteVolume(volume.ID); KindOf(err) != ErrConflict {
+			t.Errorf("DeleteVolume during the create: got %v, want a conflict", err)
+		}
+	}}
+	container, err := serviceHandler.CreateContainer(service.ID, ServiceTemplate{Mounts: []VolumeMount{{Volume: "data", Path: "/data"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandboxClient = fake
+	if err := volumeHandler.DeleteVolume(volume.ID); KindOf(err) != ErrConflict {
+		t.Errorf("DeleteVolume: got %v, want a conflict with the new container", err)
+	}
+
+	// Once nothing mounts it any more, it can go
+	service, err = serviceHandler.GetService(service.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := volumeHandler.DeleteVolume(volume.ID); err != nil {
+		t.Errorf("DeleteVolume after the container is gone: %v", err)
+	}
+	if _, err := serviceHandler.CreateService("db", ServiceTemplate{Mounts: []VolumeMount{{Volume: "data", Path: "/data"}}}, 0); KindOf(err) != ErrValidation {
+		t.Errorf("creating a service mounting the deleted volume: %v, want a validation error", err)
+	}
+}
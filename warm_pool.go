@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// WarmPool keeps a number of empty servers provisioned ahead of demand, so the
+// scheduler can place containers without waiting for a new server to boot.
+// Whenever a warm server gets used, the pool provisions a replacement in the
+// background. At most warmPoolMaxInFlight servers are created at once, and
+// after a failed create the pool backs off exponentially before trying again,
+// so a broken provider or image doesn't run up a fleet of dead servers.
+type WarmPool struct {
+	mu           sync.Mutex
+	config       WarmPoolConfig
+	provisioning int
+	// failures counts consecutive failed creates; none are started before
+	// retryAt.
+	failures int
+	retryAt  time.Time
+	wake     chan struct{}
+}
+
+const (
+	warmPoolMaxInFlight  = 2
+	warmPoolBackoffFirst = 30 * time.Second
+	warmPoolBackoffMax   = 30 * time.Minute
+)
+
+type WarmPoolServer struct {
+	Server Server `json:"server"`
+	// Ready is true once the server's agent answers its health check.
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+type WarmPoolStatus struct {
+	Size         int              `json:"size"`
+	Provisioning int              `json:"provisioning"`
+	Servers      []WarmPoolServer `json:"servers"`
+	// RetryAt is set while the pool backs off after failed creates.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+func NewWarmPool(config WarmPoolConfig) *WarmPool {
+	return &WarmPool{
+		config: config,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Trigger asks for the pool to be topped up soon, e.g. after a container was
+// placed on one of its servers.
+func (p *WarmPool) Trigger() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *WarmPool) Run(ctx context.Context) {
+	if p.config.Size == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.config.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	p.replenish()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+		p.replenish()
+	}
+}
+
+// Status lists the empty, schedulable servers currently in the pool and
+// whether their agents are healthy.
+func (p *WarmPool) Status() (WarmPoolStatus, error) {
+	servers, _, err := p.idleServers()
+	if err != nil {
+		return WarmPoolStatus{}, err
+	}
+
+	p.mu.Lock()
+	status := WarmPoolStatus{Size: p.config.Size, Provisioning: p.provisioning, Servers: []WarmPoolServer{}}
+	if time.Now().Before(p.retryAt) {
+		retryAt := p.retryAt
+		status.RetryAt = &retryAt
+	}
+	p.mu.Unlock()
+
+	for _, server := range servers {
+		warm := WarmPoolServer{Server: server, Ready: true}
+		if err := sandboxClient.Health(server.IP); err != nil {
+			warm.Ready = false
+			warm.Error = err.Error()
+		}
+		status.Servers = append(status.Servers, warm)
+	}
+	return status, nil
+}
+
+// replenish starts creating the servers the pool is short of. Empty servers
+// that are still booting or whose agent doesn't answer count towards the
+// pool, so servers that never come up aren't replaced over and over; the
+// pool's own creates show up as booting servers once the provider has them.
+func (p *WarmPool) replenish() {
+	servers, booting, err := p.idleServers()
+	if err != nil {
+		log.Printf("Warm pool: %v", err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().Before(p.retryAt) {
+		return
+	}
+	missing := p.config.Size - len(servers) - max(booting, p.provisioning)
+	missing = min(missing, warmPoolMaxInFlight-p.provisioning)
+	for i := 0; i < missing; i++ {
+		p.provisioning++
+		go p.provision()
+	}
+}
+
+func (p *WarmPool) provision() {
+	err := p.create()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.provisioning--
+	if err == nil {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	backoff := warmPoolBackoffFirst
+	for i := 1; i < p.failures && backoff < warmPoolBackoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, warmPoolBackoffMax)
+	p.retryAt = time.Now().Add(backoff)
+	log.Printf("Warm pool: provisioning a server failed, retrying in %s: %v", backoff, err)
+}
+
+func (p *WarmPool) create() error {
+	randomString, err := randomHex(3)
+	if err != nil {
+		return err
+	}
+	server, err := serverHandler.CreateServer(fmt.Sprintf("jcs-%s", randomString), "", "")
+	if err != nil {
+		return err
+	}
+	log.Printf("Warm pool: provisioned server '%s'", server.ID)
+	return nil
+}
+
+// idleServers returns the schedulable servers with nothing placed on them,
+// and counts the empty ones that are provisioning or unreachable.
+func (p *WarmPool) idleServers() ([]Server, int, error) {
+	loads, err := scheduler.Loads()
+	if err != nil {
+		return nil, 0, err
+	}
+	servers := []Server{}
+	booting := 0
+	for _, load := range loads {
+		if load.Containers > 0 {
+			continue
+		}
+		switch {
+		case load.Server.Schedulable():
+			servers = append(servers, load.Server)
+		case load.Server.Status == "provisioning" || load.Server.Status == "unreachable":
+			booting++
+		}
+	}
+	return servers, booting, nil
+}
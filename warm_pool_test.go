@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingServerAdapter has no servers and fails every create.
+type failingServerAdapter struct {
+	mu      sync.Mutex
+	creates int
+}
+
+func (f *failingServerAdapter) ListServers() ([]RemoteServer, error) {
+	return nil, nil
+}
+
+func (f *failingServerAdapter) GetServer(ID string) (RemoteServer, error) {
+	return RemoteServer{}, NotFoundError("Server not found with ID: '%s'", ID)
+}
+
+func (f *failingServerAdapter) CreateServer(name string, serverType string, location string, bootstrapToken string) (RemoteServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creates++
+	return RemoteServer{}, ProviderUnavailableError(errors.New("out of capacity"), "Provider failed to create server '%s'", name)
+}
+
+func (f *failingServerAdapter) DeleteServer(ID string) error {
+	return nil
+}
+
+func TestWarmPoolBacksOffAfterFailedCreates(t *testing.T) {
+	newTestCluster(t)
+	adapter := &failingServerAdapter{}
+	serverHandler.ServerAdapter = adapter
+	pool := NewWarmPool(WarmPoolConfig{Size: 5, IntervalSeconds: 1})
+
+	pool.replenish()
+	pool.mu.Lock()
+	inFlight := pool.provisioning
+	pool.mu.Unlock()
+	if inFlight > warmPoolMaxInFlight {
+		t.Fatalf("%d creates in flight, want at most %d", inFlight, warmPoolMaxInFlight)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		done := pool.provisioning == 0
+		pool.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("creates still in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status, err := pool.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RetryAt == nil || !status.RetryAt.After(time.Now()) {
+		t.Fatalf("pool isn't backing off after failed creates: %+v", status)
+	}
+	pool.replenish()
+	adapter.mu.Lock()
+	creates := adapter.creates
+	adapter.mu.Unlock()
+	if creates != inFlight {
+		t.Errorf("%d creates while backing off, want %d", creates, inFlight)
+	}
+}